@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---------- Account settings ----------
+
+const (
+	minPasswordLen         = 8
+	maxPasswordLen         = 72 // bcrypt ignores anything longer
+	usernameChangeCooldown = 30 * 24 * time.Hour
+	// password_hash of accounts created through OIDC; no password matches it
+	noPassword = "!"
+)
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,30}$`)
+
+// numericUsername reports whether name is all digits. Such names aren't
+// allowed because /users/{ref} reads a numeric ref as a user ID.
+func numericUsername(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && strings.Trim(name, "0123456789") == ""
+}
+
+// publicURL builds an absolute link to this API for use in emails.
+func publicURL(path string) string {
+	return strings.TrimRight(cfg.PublicAPIURL, "/") + path
+}
+
+// humanDuration spells d out for emails, e.g. "24 hours" or "90 minutes".
+func humanDuration(d time.Duration) string {
+	unit := func(n int64, name string) string {
+		if n == 1 {
+			return "1 " + name
+		}
+		return strconv.FormatInt(n, 10) + " " + name + "s"
+	}
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		return unit(int64(d/(24*time.Hour)), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return unit(int64(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return unit(int64(d/time.Minute), "minute")
+	}
+	return d.String()
+}
+
+func checkPassword(ctx context.Context, uid int, password string) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var hash string
+	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id=$1`, uid).Scan(&hash); err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// usernameReserved reports whether name used to belong to another account.
+// Old names stay reserved so links to them keep redirecting to the right user,
+// and the placeholder account's name is never available.
+func usernameReserved(ctx context.Context, name string, uid int) (bool, error) {
+	if strings.EqualFold(strings.TrimSpace(name), deletedUserName) {
+		return true, nil
+	}
+	return store.UsernameReserved(ctx, name, uid)
+}
+
+// ---------- PUT /me/password ----------
+//
+// Accounts created through OIDC have no password; they set their first one
+// without current_password and can then confirm deleting the account,
+// changing the email or two-factor settings with it.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	if len(payload.NewPassword) < minPasswordLen || len(payload.NewPassword) > maxPasswordLen {
+		invalidFields(w, FieldError{"new_password", "invalid_length", "must be 8 to 72 characters"})
+		return
+	}
+
+	var current string
+	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id=$1`, uid).Scan(&current); err != nil {
+		serverError(w, "PASSWORD CHANGE", err)
+		return
+	}
+	if current != noPassword && bcrypt.CompareHashAndPassword([]byte(current), []byte(payload.CurrentPassword)) != nil {
+		writeError(w, http.StatusForbidden, "wrong_password", "Current password is incorrect")
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(payload.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		serverError(w, "CHANGE PASSWORD", err)
+		return
+	}
+
+	var email string
+	if err := db.QueryRowContext(ctx, `UPDATE users SET password_hash=$1 WHERE id=$2 RETURNING email`, string(hashed), uid).Scan(&email); err != nil {
+		serverError(w, "PASSWORD CHANGE", err)
+		return
+	}
+
+	// everyone else holding a token for this account is logged out
+	if err := revokeSessions(ctx, uid, getSessionID(r)); err != nil {
+		slog.ErrorContext(ctx, "session revoke failed", "user_id", uid, "err", err)
+	}
+	sendMailAsync(r.Context(), email, "Your Webby password was changed",
+		"The password for your account was just changed and all other sessions were signed out.\n"+
+			"If this wasn't you, reset your password right away.")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------- PUT /me/email ----------
+//
+// The new address only takes effect once the link sent to it is opened.
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	addr, err := mail.ParseAddress(payload.Email)
+	if err != nil || addr.Address != strings.TrimSpace(payload.Email) {
+		invalidFields(w, FieldError{"email", "invalid_email", "is not a valid email address"})
+		return
+	}
+	newEmail := normalizeEmail(addr.Address)
+
+	ok, err := checkPassword(ctx, uid, payload.Password)
+	if err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "wrong_password", "Password is incorrect")
+		return
+	}
+
+	var taken bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email)=lower($1))`, newEmail).Scan(&taken); err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	if taken || emailReserved(newEmail) {
+		writeError(w, http.StatusConflict, "email_taken", "Email already exists")
+		return
+	}
+
+	token := randomToken(32)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id=$1`, uid); err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO email_changes (token_hash, user_id, new_email, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, hashToken(token), uid, newEmail, time.Now().Add(cfg.Tokens.EmailChangeTTL)); err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	var oldEmail string
+	if err := tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id=$1`, uid).Scan(&oldEmail); err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, "EMAIL CHANGE", err)
+		return
+	}
+
+	sendMailAsync(r.Context(), newEmail, "Confirm your new Webby email address",
+		"Open this link within "+humanDuration(cfg.Tokens.EmailChangeTTL)+" to use this address for your account:\n\n"+
+			publicURL("/email/confirm?token="+url.QueryEscape(token)))
+	sendMailAsync(r.Context(), oldEmail, "Email change requested on Webby",
+		"Someone asked to change your account email to "+newEmail+".\n"+
+			"Nothing changes until the new address is confirmed. If this wasn't you, change your password.")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"pending_email": newEmail,
+	})
+}
+
+// ---------- GET /email/confirm ----------
+//
+// Public on purpose: the token from the mail is the proof, and the link is
+// usually opened somewhere without a session.
+func confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeError(w, 400, "missing_token", "Missing token")
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "EMAIL CONFIRM", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var uid int
+	var newEmail string
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM email_changes WHERE token_hash=$1 AND expires_at > NOW()
+		RETURNING user_id, new_email
+	`, hashToken(token)).Scan(&uid, &newEmail)
+	if err == sql.ErrNoRows {
+		writeError(w, 400, "invalid_link", "Invalid or expired link")
+		return
+	}
+	if err != nil {
+		serverError(w, "EMAIL CONFIRM", err)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET email=$1 WHERE id=$2`, newEmail, uid); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Constraint == "users_email_key" || pqErr.Constraint == "users_email_unique" || pqErr.Constraint == "users_email_lower_key") {
+			writeError(w, http.StatusConflict, "email_taken", "Email already exists")
+			return
+		}
+		serverError(w, "EMAIL CONFIRM", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, "EMAIL CONFIRM", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"email": newEmail,
+	})
+}
+
+// ---------- PUT /me/username ----------
+func changeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Username string `json:"username"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	newName := strings.TrimSpace(payload.Username)
+	if !usernameRe.MatchString(newName) {
+		invalidFields(w, FieldError{"username", "invalid_format", "must be 3-30 letters, digits, '.', '_' or '-'"})
+		return
+	}
+	if numericUsername(newName) {
+		invalidFields(w, FieldError{"username", "invalid_format", "can't be only digits"})
+		return
+	}
+
+	reserved, err := usernameReserved(ctx, newName, uid)
+	if err != nil {
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+	if reserved {
+		writeError(w, http.StatusConflict, "username_taken", "Username already exists")
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	var changedAt sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT username, username_changed_at FROM users WHERE id=$1 FOR UPDATE`, uid).
+		Scan(&oldName, &changedAt); err != nil {
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+	if oldName == newName {
+		writeError(w, 400, "username_unchanged", "That is already your username")
+		return
+	}
+	if changedAt.Valid && time.Since(changedAt.Time) < usernameChangeCooldown {
+		next := changedAt.Time.Add(usernameChangeCooldown).UTC().Format(time.RFC3339)
+		writeError(w, http.StatusTooManyRequests, "username_cooldown", "You can change your username again after "+next)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET username=$1, username_changed_at=NOW() WHERE id=$2`, newName, uid); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "users_username_key" {
+			writeError(w, http.StatusConflict, "username_taken", "Username already exists")
+			return
+		}
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+
+	// taking back one of your own old names un-reserves it
+	if _, err := tx.ExecContext(ctx, `DELETE FROM username_history WHERE lower(old_username)=lower($1) AND user_id=$2`, newName, uid); err != nil {
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+	if !strings.EqualFold(oldName, newName) {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO username_history (old_username, user_id) VALUES ($1, $2)
+			ON CONFLICT ((lower(old_username))) DO UPDATE SET user_id=EXCLUDED.user_id, changed_at=NOW()
+		`, oldName, uid); err != nil {
+			serverError(w, "USERNAME CHANGE", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, "USERNAME CHANGE", err)
+		return
+	}
+
+	p, err := loadProfile(ctx, uid)
+	if err != nil {
+		serverError(w, "PROFILE", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// redirectRenamedUser answers /users/{old name}/... with a permanent redirect
+// to the current name. It returns false when ref isn't a former username.
+func redirectRenamedUser(w http.ResponseWriter, r *http.Request, ref string) bool {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	var current string
+	err := db.QueryRowContext(ctx, `
+		SELECT u.username
+		FROM username_history h
+		JOIN users u ON u.id = h.user_id
+		WHERE lower(h.old_username)=lower($1)
+	`, ref).Scan(&current)
+	if err != nil {
+		return false
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/users/"+ref)
+	target := "/users/" + url.PathEscape(current) + rest
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import "unicode"
+
+// acMatcher is an Aho-Corasick automaton over lower-cased runes. It finds all
+// occurrences of many fixed words in a single pass over the text.
+type acMatcher struct {
+	next [](map[rune]int)
+	fail []int
+	out  [][]int // pattern indices ending at each node
+	lens []int   // pattern length in runes
+}
+
+type acMatch struct {
+	Pattern    int
+	Start, End int // rune offsets, End exclusive
+}
+
+func newACMatcher(patterns []string) *acMatcher {
+	m := &acMatcher{
+		next: []map[rune]int{{}},
+		fail: []int{0},
+		out:  [][]int{nil},
+	}
+
+	for i, p := range patterns {
+		node := 0
+		n := 0
+		for _, r := range p {
+			r = unicode.ToLower(r)
+			child, ok := m.next[node][r]
+			if !ok {
+				child = len(m.next)
+				m.next = append(m.next, map[rune]int{})
+				m.fail = append(m.fail, 0)
+				m.out = append(m.out, nil)
+				m.next[node][r] = child
+			}
+			node = child
+			n++
+		}
+		m.lens = append(m.lens, n)
+		if n > 0 {
+			m.out[node] = append(m.out[node], i)
+		}
+	}
+
+	// breadth-first to fill failure links
+	queue := make([]int, 0, len(m.next))
+	for _, child := range m.next[0] {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for r, child := range m.next[node] {
+			queue = append(queue, child)
+			f := m.fail[node]
+			for f != 0 {
+				if _, ok := m.next[f][r]; ok {
+					break
+				}
+				f = m.fail[f]
+			}
+			if target, ok := m.next[f][r]; ok && target != child {
+				m.fail[child] = target
+			}
+			m.out[child] = append(m.out[child], m.out[m.fail[child]]...)
+		}
+	}
+	return m
+}
+
+// FindAll returns every match in text, in order of their end position.
+func (m *acMatcher) FindAll(text []rune) []acMatch {
+	var matches []acMatch
+	node := 0
+	for i, r := range text {
+		r = unicode.ToLower(r)
+		for node != 0 {
+			if _, ok := m.next[node][r]; ok {
+				break
+			}
+			node = m.fail[node]
+		}
+		node = m.next[node][r] // missing key yields 0, the root
+		for _, p := range m.out[node] {
+			matches = append(matches, acMatch{Pattern: p, Start: i + 1 - m.lens[p], End: i + 1})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---------- Command line ----------
+//
+// Every subcommand runs with the same configuration and store as the HTTP
+// server, so operators never have to reach for hand-written SQL.
+
+const cliUsage = `usage: forum-backend [flags] [command]
+
+commands:
+  serve                                       run the HTTP API (default)
+  config print                                show the effective configuration, secrets redacted
+  migrate up | down [-steps N] | status       apply or roll back schema migrations
+  user create -name N -email E [-password P] [-role R]
+  user set-role <user> <role>
+  user reset-password <user> [-password P]    also signs the user out everywhere
+  topic delete <id>                           delete a topic and its replies
+  reindex-search                              rebuild the full-text search index
+  export <user> [-o file.zip]                 write a user's data export archive
+
+<user> is a numeric ID, an email address or a username. When -password is
+left out a random one is generated and printed. Run with -h for the flags.
+`
+
+// cliOut and cliErr are swapped out by tests.
+var (
+	cliOut io.Writer = os.Stdout
+	cliErr io.Writer = os.Stderr
+)
+
+var commands = map[string]func(args []string) int{
+	"migrate":        runMigrateCommand,
+	"user":           runUserCommand,
+	"topic":          runTopicCommand,
+	"reindex-search": runReindexCommand,
+	"export":         runExportCommand,
+}
+
+// knownCommand reports whether main should open the database and hand off
+// to runCommand.
+func knownCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// runCommand runs one subcommand and returns the process exit code: 0 on
+// success, 1 when the operation failed and 2 for bad usage.
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprint(cliErr, cliUsage)
+		return 2
+	}
+	return cmd(args)
+}
+
+// parseArgs parses fset from args, allowing flags before, between and after
+// positional arguments, and returns the positional ones.
+func parseArgs(fset *flag.FlagSet, args []string) ([]string, error) {
+	fset.SetOutput(cliErr)
+	var pos []string
+	for {
+		if err := fset.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fset.Args()
+		if len(args) == 0 {
+			return pos, nil
+		}
+		pos, args = append(pos, args[0]), args[1:]
+	}
+}
+
+// lookupUser resolves a <user> argument: a numeric ID, an email address or
+// a username.
+func lookupUser(ctx context.Context, ref string) (User, error) {
+	var (
+		u   User
+		err error
+	)
+	if id, convErr := strconv.Atoi(ref); convErr == nil {
+		u, err = store.UserByID(ctx, id)
+	} else if strings.Contains(ref, "@") {
+		u, _, err = store.UserByEmail(ctx, normalizeEmail(ref))
+	} else {
+		u, err = store.UserByName(ctx, ref)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return u, fmt.Errorf("no user matches %q", ref)
+	}
+	return u, err
+}
+
+// cliPassword validates a password given on the command line, or generates
+// one when it's empty. generated is that password, for the caller to print
+// once the change has been saved.
+func cliPassword(password string) (hash, generated string, err error) {
+	if password == "" {
+		password = randomToken(12)
+		generated = password
+	} else if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return "", "", fmt.Errorf("password must be %d-%d characters", minPasswordLen, maxPasswordLen)
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return string(hashed), generated, nil
+}
+
+func printGeneratedPassword(password string) {
+	if password != "" {
+		fmt.Fprintln(cliOut, "password:", password)
+	}
+}
+
+func validRole(role string) bool {
+	switch role {
+	case roleUser, roleModerator, roleAdmin:
+		return true
+	}
+	return false
+}
+
+// ---------- user ----------
+func runUserCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(cliErr, "usage: forum-backend user create -name N -email E [-password P] [-role R]")
+		fmt.Fprintln(cliErr, "       forum-backend user set-role <user> <role>")
+		fmt.Fprintln(cliErr, "       forum-backend user reset-password <user> [-password P]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		fset := flag.NewFlagSet("user create", flag.ContinueOnError)
+		name := fset.String("name", "", "username")
+		email := fset.String("email", "", "email address")
+		password := fset.String("password", "", "password (generated when empty)")
+		role := fset.String("role", roleUser, "user, moderator or admin")
+		pos, err := parseArgs(fset, args[1:])
+		if err != nil {
+			return 2
+		}
+		if len(pos) > 0 || *name == "" || *email == "" {
+			usage()
+			return 2
+		}
+		if !validRole(*role) {
+			fmt.Fprintf(cliErr, "unknown role %q\n", *role)
+			return 2
+		}
+		if numericUsername(*name) {
+			fmt.Fprintln(cliErr, "user create: username can't be only digits")
+			return 2
+		}
+		if reserved, err := usernameReserved(ctx, *name, 0); err != nil {
+			fmt.Fprintln(cliErr, "user create:", err)
+			return 1
+		} else if reserved {
+			fmt.Fprintln(cliErr, "user create:", ErrUsernameTaken)
+			return 1
+		}
+		if emailReserved(*email) {
+			fmt.Fprintln(cliErr, "user create:", ErrEmailTaken)
+			return 1
+		}
+		hash, generated, err := cliPassword(*password)
+		if err != nil {
+			fmt.Fprintln(cliErr, "user create:", err)
+			return 2
+		}
+		u := User{Username: *name, Email: normalizeEmail(*email)}
+		if err := store.CreateUser(ctx, &u, hash); err != nil {
+			fmt.Fprintln(cliErr, "user create:", err)
+			return 1
+		}
+		if *role != roleUser {
+			if err := store.SetRole(ctx, u.ID, *role); err != nil {
+				fmt.Fprintln(cliErr, "user create:", err)
+				return 1
+			}
+		}
+		fmt.Fprintf(cliOut, "created user %d (%s, %s)\n", u.ID, u.Username, *role)
+		printGeneratedPassword(generated)
+
+	case "set-role":
+		if len(args) != 3 {
+			usage()
+			return 2
+		}
+		if !validRole(args[2]) {
+			fmt.Fprintf(cliErr, "unknown role %q\n", args[2])
+			return 2
+		}
+		u, err := lookupUser(ctx, args[1])
+		if err == nil {
+			err = store.SetRole(ctx, u.ID, args[2])
+		}
+		if err != nil {
+			fmt.Fprintln(cliErr, "user set-role:", err)
+			return 1
+		}
+		fmt.Fprintf(cliOut, "user %d (%s) is now %s\n", u.ID, u.Username, args[2])
+
+	case "reset-password":
+		fset := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+		password := fset.String("password", "", "new password (generated when empty)")
+		pos, err := parseArgs(fset, args[1:])
+		if err != nil {
+			return 2
+		}
+		if len(pos) != 1 {
+			usage()
+			return 2
+		}
+		u, err := lookupUser(ctx, pos[0])
+		if err != nil {
+			fmt.Fprintln(cliErr, "user reset-password:", err)
+			return 1
+		}
+		hash, generated, err := cliPassword(*password)
+		if err != nil {
+			fmt.Fprintln(cliErr, "user reset-password:", err)
+			return 2
+		}
+		if err := store.SetPasswordHash(ctx, u.ID, hash); err != nil {
+			fmt.Fprintln(cliErr, "user reset-password:", err)
+			return 1
+		}
+		if err := store.RevokeSessions(ctx, u.ID, ""); err != nil {
+			fmt.Fprintln(cliErr, "user reset-password: revoking sessions:", err)
+			return 1
+		}
+		fmt.Fprintf(cliOut, "password reset for user %d (%s); all sessions revoked\n", u.ID, u.Username)
+		printGeneratedPassword(generated)
+
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
+
+// ---------- topic ----------
+func runTopicCommand(args []string) int {
+	if len(args) != 2 || args[0] != "delete" {
+		fmt.Fprintln(cliErr, "usage: forum-backend topic delete <id>")
+		return 2
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Fprintf(cliErr, "invalid topic id %q\n", args[1])
+		return 2
+	}
+	ctx := context.Background()
+	if _, err = store.TopicOwner(ctx, id); err == nil {
+		err = store.DeleteTopic(ctx, id)
+	}
+	if errors.Is(err, ErrNotFound) {
+		err = fmt.Errorf("no topic %d", id)
+	}
+	if err != nil {
+		fmt.Fprintln(cliErr, "topic delete:", err)
+		return 1
+	}
+	fmt.Fprintf(cliOut, "deleted topic %d\n", id)
+	return 0
+}
+
+// ---------- reindex-search ----------
+func runReindexCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(cliErr, "usage: forum-backend reindex-search")
+		return 2
+	}
+	ctx := context.Background()
+	if err := store.ReindexSearch(ctx); err != nil {
+		fmt.Fprintln(cliErr, "reindex-search:", err)
+		return 1
+	}
+	fmt.Fprintln(cliOut, "search index rebuilt")
+	return 0
+}
+
+// ---------- export ----------
+func runExportCommand(args []string) int {
+	fset := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fset.String("o", "", "archive path (default export-<id>.zip)")
+	pos, err := parseArgs(fset, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 1 {
+		fmt.Fprintln(cliErr, "usage: forum-backend export <user> [-o file.zip]")
+		return 2
+	}
+	if dbDriver != driverPostgres {
+		fmt.Fprintln(cliErr, "export: data exports need the Postgres backend")
+		return 1
+	}
+	ctx := context.Background()
+	u, err := lookupUser(ctx, pos[0])
+	if err != nil {
+		fmt.Fprintln(cliErr, "export:", err)
+		return 1
+	}
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("export-%d.zip", u.ID)
+	}
+	if err := writeExportArchive(ctx, u.ID, path); err != nil {
+		_ = os.Remove(path)
+		fmt.Fprintln(cliErr, "export:", err)
+		return 1
+	}
+	fmt.Fprintf(cliOut, "wrote %s for user %d (%s)\n", path, u.ID, u.Username)
+	return 0
+}
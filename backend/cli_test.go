@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// runCLI runs a subcommand against a's store and returns its exit code and
+// standard output.
+func (a *testAPI) runCLI(args ...string) (int, string) {
+	a.t.Helper()
+	var out, errOut bytes.Buffer
+	prevOut, prevErr := cliOut, cliErr
+	cliOut, cliErr = &out, &errOut
+	defer func() { cliOut, cliErr = prevOut, prevErr }()
+	code := runCommand(args[0], args[1:])
+	if code != 0 {
+		a.t.Logf("%s: %s", strings.Join(args, " "), errOut.String())
+	}
+	return code, out.String()
+}
+
+func TestCLIUserCommands(t *testing.T) {
+	a := newTestAPI(t)
+
+	code, out := a.runCLI("user", "create", "-name", "root", "-email", "Root@Example.com", "-role", "admin")
+	if code != 0 {
+		t.Fatalf("user create exited %d", code)
+	}
+	var password string
+	for line := range strings.Lines(out) {
+		if p, ok := strings.CutPrefix(line, "password: "); ok {
+			password = strings.TrimSpace(p)
+		}
+	}
+	if password == "" {
+		t.Fatalf("no generated password in %q", out)
+	}
+	rec := a.do("POST", "/login", "", map[string]string{"email": "root@example.com", "password": password})
+	expectStatus(t, rec, http.StatusOK)
+	root, err := store.UserByName(t.Context(), "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, role, _ := store.UserAccess(t.Context(), root.ID); role != roleAdmin {
+		t.Fatalf("role = %q, want admin", role)
+	}
+
+	if code, _ := a.runCLI("user", "create", "-name", "root", "-email", "other@example.com"); code != 1 {
+		t.Fatalf("duplicate user create exited %d, want 1", code)
+	}
+	if code, _ := a.runCLI("user", "create", "-name", "x", "-email", "x@example.com", "-role", "owner"); code != 2 {
+		t.Fatalf("unknown role exited %d, want 2", code)
+	}
+
+	// users can be named by ID, email or username
+	_, tok := a.member("ada")
+	for _, ref := range []string{"ada", "ADA@example.com", fmt.Sprint(root.ID + 1)} {
+		if code, _ := a.runCLI("user", "set-role", ref, roleModerator); code != 0 {
+			t.Fatalf("set-role %s exited %d", ref, code)
+		}
+	}
+	if code, _ := a.runCLI("user", "set-role", "nobody", roleAdmin); code != 1 {
+		t.Fatalf("set-role for a missing user exited %d, want 1", code)
+	}
+
+	if code, _ := a.runCLI("user", "reset-password", "ada", "-password", "short"); code != 2 {
+		t.Fatalf("short password exited %d, want 2", code)
+	}
+	if code, _ := a.runCLI("user", "reset-password", "ada", "-password", "correct horse"); code != 0 {
+		t.Fatalf("reset-password exited %d", code)
+	}
+	rec = a.do("POST", "/topics", tok, map[string]string{"title": "t", "content": "c"})
+	expectProblem(t, rec, http.StatusUnauthorized, "unauthorized")
+	rec = a.do("POST", "/login", "", map[string]string{"email": "ada@example.com", "password": "correct horse"})
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestCLITopicDelete(t *testing.T) {
+	a := newTestAPI(t)
+	_, tok := a.member("ada")
+	topic := a.createTopic(tok, "Hello", "First post")
+
+	id := fmt.Sprint(topic.ID)
+	if code, _ := a.runCLI("topic", "delete", id); code != 0 {
+		t.Fatalf("topic delete exited %d", code)
+	}
+	expectProblem(t, a.do("GET", "/topics/"+id, "", nil), http.StatusNotFound, "topic_not_found")
+	if code, _ := a.runCLI("topic", "delete", id); code != 1 {
+		t.Fatalf("deleting a missing topic exited %d, want 1", code)
+	}
+	if code, _ := a.runCLI("topic", "delete", "abc"); code != 2 {
+		t.Fatalf("bad topic id exited %d, want 2", code)
+	}
+	if code, _ := a.runCLI("reindex-search"); code != 0 {
+		t.Fatalf("reindex-search exited %d", code)
+	}
+}
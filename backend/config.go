@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------- Configuration ----------
+//
+// Settings are layered, later sources winning: built-in defaults, the YAML
+// file named by -config or CONFIG_FILE, environment variables (.env
+// included) and the flags given before the subcommand. The result is
+// validated once at startup and read from cfg afterwards.
+//
+// Struct tags drive the loading: yaml is the file key, env the variable
+// (list settings concatenate every variable named), flag the command-line
+// flag and secret marks values that `config print` redacts.
+
+type Config struct {
+	Port           int    `yaml:"port" env:"PORT" flag:"port" usage:"HTTP listen port"`
+	PublicAPIURL   string `yaml:"public_api_url" env:"PUBLIC_API_URL" flag:"public-api-url" usage:"absolute URL of this API, used in emails"`
+	SiteURL        string `yaml:"site_url" env:"SITE_URL"`
+	JWTSecret      string `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	TrustProxy     bool   `yaml:"trust_proxy" env:"TRUST_PROXY"`
+	ProxyHops      int    `yaml:"proxy_hops" env:"PROXY_HOPS"` // proxies in front that append to X-Forwarded-For
+	CookieSameSite string `yaml:"cookie_samesite" env:"COOKIE_SAMESITE"`
+	UploadDir      string `yaml:"upload_dir" env:"UPLOAD_DIR" flag:"upload-dir" usage:"directory for avatar uploads"`
+	ExportDir      string `yaml:"export_dir" env:"EXPORT_DIR" flag:"export-dir" usage:"directory for data export archives"`
+	AutoMigrate    bool   `yaml:"auto_migrate" env:"AUTO_MIGRATE" flag:"auto-migrate" usage:"apply pending migrations on startup"`
+	TOTPIssuer     string `yaml:"totp_issuer" env:"TOTP_ISSUER"`
+	// how long shutdown waits for in-flight requests and background work
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	Log      LogConfig      `yaml:"log"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+	Database DatabaseConfig `yaml:"database"`
+	Tokens   TokenConfig    `yaml:"tokens"`
+	Limits   LimitConfig    `yaml:"limits"`
+	CORS     CORSConfig     `yaml:"cors"`
+	SMTP     SMTPConfig     `yaml:"smtp"`
+	OIDC     oidcConfig     `yaml:"oidc"`
+	Spam     SpamConfig     `yaml:"spam"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"minimum log level: debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT"` // json or text
+}
+
+type DatabaseConfig struct {
+	URL             string        `yaml:"url" env:"DATABASE_URL" flag:"database-url" usage:"Postgres URL or sqlite:path" secret:"url"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	QueryTimeout    time.Duration `yaml:"query_timeout" env:"DB_QUERY_TIMEOUT"`
+}
+
+type TokenConfig struct {
+	SessionTTL     time.Duration `yaml:"session_ttl" env:"SESSION_TTL"`
+	EmailChangeTTL time.Duration `yaml:"email_change_ttl" env:"EMAIL_CHANGE_TTL"`
+}
+
+type LimitConfig struct {
+	MaxBodyBytes   int64 `yaml:"max_body_bytes" env:"MAX_BODY_BYTES"`
+	MaxPostBytes   int64 `yaml:"max_post_bytes" env:"MAX_POST_BYTES"`
+	MaxUploadBytes int64 `yaml:"max_upload_bytes" env:"MAX_UPLOAD_BYTES"`
+}
+
+type CORSConfig struct {
+	// FRONTEND_ORIGIN and FRONTEND_ORIGIN_2 predate CORS_ORIGINS
+	Origins          []string `yaml:"origins" env:"CORS_ORIGINS,FRONTEND_ORIGIN,FRONTEND_ORIGIN_2"`
+	AllowCredentials bool     `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	ExposeHeaders    []string `yaml:"expose_headers" env:"CORS_EXPOSE_HEADERS"`
+	MaxAge           int      `yaml:"max_age" env:"CORS_MAX_AGE"`
+}
+
+type SMTPConfig struct {
+	Addr     string `yaml:"addr" env:"SMTP_ADDR"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type SpamConfig struct {
+	MaxLinks           int    `yaml:"max_links" env:"SPAM_MAX_LINKS"`
+	NewAccountMaxLinks int    `yaml:"new_account_max_links" env:"SPAM_NEW_ACCOUNT_MAX_LINKS"`
+	RulesFile          string `yaml:"rules_file" env:"SPAM_RULES_FILE"`
+	AkismetKey         string `yaml:"akismet_key" env:"AKISMET_KEY" secret:"true"`
+	AkismetURL         string `yaml:"akismet_url" env:"AKISMET_URL"`
+}
+
+// cfg is the running configuration. Tests get the defaults.
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port:            5000,
+		PublicAPIURL:    "http://localhost:5000",
+		CookieSameSite:  "lax",
+		ProxyHops:       1,
+		UploadDir:       "./uploads",
+		ExportDir:       "./exports",
+		TOTPIssuer:      totpIssuerFallback,
+		ShutdownTimeout: 30 * time.Second,
+		Log:             LogConfig{Level: "info", Format: "json"},
+		Tracing:         TracingConfig{Exporter: "none", ServiceName: "forum-backend", SampleRatio: 1},
+		Database: DatabaseConfig{
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			QueryTimeout:    10 * time.Second,
+		},
+		Tokens: TokenConfig{
+			SessionTTL:     24 * time.Hour,
+			EmailChangeTTL: 24 * time.Hour,
+		},
+		Limits: LimitConfig{
+			MaxBodyBytes:   64 << 10,
+			MaxPostBytes:   256 << 10,
+			MaxUploadBytes: 5 << 20,
+		},
+		CORS: CORSConfig{
+			AllowCredentials: true,
+			ExposeHeaders:    []string{"Retry-After", "Location"},
+			MaxAge:           86400,
+		},
+		OIDC: oidcConfig{Scopes: "openid email profile"},
+		Spam: SpamConfig{
+			MaxLinks:   5,
+			AkismetURL: "https://rest.akismet.com",
+		},
+	}
+}
+
+// minSecretLen is the shortest JWT_SECRET accepted; HMAC-SHA256 keys
+// shorter than the hash add nothing but guessability.
+const minSecretLen = 32
+
+// loadConfig parses the global flags in args and layers defaults, the
+// config file, the environment and those flags. It returns the arguments
+// left after the flags: the subcommand and its own arguments.
+func loadConfig(args []string) (Config, []string, error) {
+	c := defaultConfig()
+
+	fset := flag.NewFlagSet("forum-backend", flag.ContinueOnError)
+	fset.SetOutput(cliErr)
+	fset.Usage = func() {
+		fmt.Fprint(cliErr, cliUsage)
+		fmt.Fprintln(cliErr, "\nflags (before the command):")
+		fset.PrintDefaults()
+	}
+	path := fset.String("config", "", "YAML config file (default $CONFIG_FILE)")
+	var flagValues []func() error
+	err := walkConfig(&c, func(key string, f reflect.StructField, v reflect.Value) error {
+		name := f.Tag.Get("flag")
+		if name == "" {
+			return nil
+		}
+		// flags win over the file and environment read below, so values
+		// are only checked now and applied last
+		set := func(s string) error {
+			if err := setConfigValue(reflect.New(v.Type()).Elem(), s); err != nil {
+				return err
+			}
+			flagValues = append(flagValues, func() error { return setConfigValue(v, s) })
+			return nil
+		}
+		if v.Kind() == reflect.Bool {
+			fset.BoolFunc(name, f.Tag.Get("usage"), set)
+		} else {
+			fset.Func(name, f.Tag.Get("usage"), set)
+		}
+		return nil
+	})
+	if err != nil {
+		return c, nil, err
+	}
+	if err := fset.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	if *path == "" {
+		*path = os.Getenv("CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := readConfigFile(&c, *path); err != nil {
+			return c, nil, err
+		}
+	}
+
+	err = walkConfig(&c, func(key string, f reflect.StructField, v reflect.Value) error {
+		names := f.Tag.Get("env")
+		if names == "" {
+			return nil
+		}
+		if v.Kind() == reflect.Slice {
+			var list []string
+			found := false
+			for _, name := range strings.Split(names, ",") {
+				if s, ok := os.LookupEnv(name); ok {
+					list, found = append(list, splitList(s)...), true
+				}
+			}
+			if found {
+				v.Set(reflect.ValueOf(list))
+			}
+			return nil
+		}
+		if s := os.Getenv(names); s != "" {
+			if err := setConfigValue(v, s); err != nil {
+				return fmt.Errorf("%s: %w", names, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c, nil, err
+	}
+
+	for _, apply := range flagValues {
+		if err := apply(); err != nil {
+			return c, nil, err
+		}
+	}
+	return c, fset.Args(), nil
+}
+
+func readConfigFile(c *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// walkConfig calls fn for every setting in c, descending into sections.
+// key is the dotted YAML path.
+func walkConfig(c *Config, fn func(key string, f reflect.StructField, v reflect.Value) error) error {
+	var walk func(prefix string, v reflect.Value) error
+	walk = func(prefix string, v reflect.Value) error {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := prefix + yamlKey(f)
+			if f.Type.Kind() == reflect.Struct {
+				if err := walk(key+".", v.Field(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(key, f, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("", reflect.ValueOf(c).Elem())
+}
+
+func yamlKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return key
+}
+
+// setConfigValue parses s into a setting of any of the kinds Config uses.
+func setConfigValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == reflect.TypeFor[time.Duration]():
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice:
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// validate reports every problem at once. The JWT secret is only needed to
+// serve; the admin commands never sign tokens.
+func (c *Config) validate(serving bool) error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	checkURL := func(key, s string) {
+		if s == "" {
+			return
+		}
+		if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("%s: %q is not an absolute http(s) URL", key, s)
+		}
+	}
+
+	if c.Database.URL == "" {
+		bad("database.url (DATABASE_URL) is not set")
+	} else if err := checkDatabaseURL(c.Database.URL); err != nil {
+		bad("database.url: %v", err)
+	}
+	switch {
+	case c.JWTSecret == "" && serving:
+		bad("jwt_secret (JWT_SECRET) is not set")
+	case c.JWTSecret != "" && len(c.JWTSecret) < minSecretLen:
+		bad("jwt_secret must be at least %d bytes; generate one with `openssl rand -hex 32`", minSecretLen)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		bad("port: %d is out of range", c.Port)
+	}
+	checkURL("public_api_url", c.PublicAPIURL)
+	checkURL("site_url", c.SiteURL)
+	switch strings.ToLower(c.CookieSameSite) {
+	case "lax", "strict", "none":
+	default:
+		bad("cookie_samesite: %q is not lax, strict or none", c.CookieSameSite)
+	}
+	if c.ProxyHops < 1 {
+		bad("proxy_hops must be at least 1")
+	}
+	if c.UploadDir == "" {
+		bad("upload_dir is empty")
+	}
+	if c.ExportDir == "" {
+		bad("export_dir is empty")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		bad("log.level: %q is not debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		bad("log.format: %q is not json or text", c.Log.Format)
+	}
+
+	if c.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+			bad("metrics.addr: %v", err)
+		}
+	}
+	if c.Metrics.Token != "" && len(c.Metrics.Token) < minSecretLen {
+		bad("metrics.token must be at least %d characters", minSecretLen)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "otlp":
+	default:
+		bad("tracing.exporter: %q is not none or otlp", c.Tracing.Exporter)
+	}
+	checkURL("tracing.endpoint", c.Tracing.Endpoint)
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		bad("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 || c.Database.ConnMaxLifetime < 0 {
+		bad("database pool settings must not be negative")
+	}
+	if c.Database.QueryTimeout <= 0 {
+		bad("database.query_timeout must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		bad("shutdown_timeout must be positive")
+	}
+	if c.Tokens.SessionTTL <= 0 || c.Tokens.EmailChangeTTL <= 0 {
+		bad("token TTLs must be positive")
+	}
+	if c.Limits.MaxBodyBytes <= 0 || c.Limits.MaxPostBytes <= 0 || c.Limits.MaxUploadBytes <= 0 {
+		bad("limits must be positive")
+	}
+
+	if _, err := newCORSPolicy(c.CORS); err != nil {
+		bad("cors.origins: %v", err)
+	}
+	if c.CORS.MaxAge < 0 {
+		bad("cors.max_age must not be negative")
+	}
+
+	if c.SMTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTP.Addr); err != nil {
+			bad("smtp.addr: %v", err)
+		}
+		if c.SMTP.From == "" {
+			bad("smtp.from (SMTP_FROM) is required with smtp.addr")
+		}
+	}
+
+	o := c.OIDC
+	if o.Issuer != "" || o.ClientID != "" || o.RedirectURL != "" {
+		if o.Issuer == "" || o.ClientID == "" || o.RedirectURL == "" {
+			bad("oidc needs issuer, client_id and redirect_url together")
+		}
+		checkURL("oidc.issuer", o.Issuer)
+		checkURL("oidc.redirect_url", o.RedirectURL)
+		checkURL("oidc.post_login_url", o.PostLoginURL)
+	}
+
+	checkURL("spam.akismet_url", c.Spam.AkismetURL)
+	if c.Spam.MaxLinks < 0 || c.Spam.NewAccountMaxLinks < 0 {
+		bad("spam link limits must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+// checkDatabaseURL accepts sqlite: paths, postgres:// URLs and libpq
+// key=value strings.
+func checkDatabaseURL(s string) error {
+	if driver, _ := databaseDriver(s); driver == driverSQLite {
+		return nil
+	}
+	if !strings.Contains(s, "://") {
+		if strings.Contains(s, "=") {
+			return nil
+		}
+		return errors.New("expected postgres://..., a key=value string or sqlite:path")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.New("malformed URL")
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// ---------- config print ----------
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// redactedSetting returns the value config print shows for a setting.
+func redactedSetting(f reflect.StructField, v reflect.Value) any {
+	switch f.Tag.Get("secret") {
+	case "true":
+		if v.String() != "" {
+			return "[redacted]"
+		}
+	case "url":
+		s := v.String()
+		if u, err := url.Parse(s); err == nil && strings.Contains(s, "://") {
+			return u.Redacted()
+		}
+		return dsnPassword.ReplaceAllString(s, "password=xxxxx")
+	}
+	return v.Interface()
+}
+
+// configYAML renders c as a config file, secrets redacted and each setting
+// annotated with its environment variable.
+func configYAML(c *Config) ([]byte, error) {
+	var section func(v reflect.Value) (*yaml.Node, error)
+	section = func(v reflect.Value) (*yaml.Node, error) {
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := &yaml.Node{Kind: yaml.ScalarNode, Value: yamlKey(f)}
+			val := &yaml.Node{}
+			if f.Type.Kind() == reflect.Struct {
+				var err error
+				if val, err = section(v.Field(i)); err != nil {
+					return nil, err
+				}
+			} else {
+				if err := val.Encode(redactedSetting(f, v.Field(i))); err != nil {
+					return nil, err
+				}
+				if env := f.Tag.Get("env"); env != "" {
+					key.LineComment = strings.ReplaceAll(env, ",", ", ")
+				}
+			}
+			n.Content = append(n.Content, key, val)
+		}
+		return n, nil
+	}
+	doc, err := section(reflect.ValueOf(c).Elem())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// runConfigCommand handles `config print`, which works without a database
+// so it can be used to debug one that won't connect.
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(cliErr, "usage: forum-backend [flags] config print")
+		return 2
+	}
+	out, err := configYAML(&cfg)
+	if err != nil {
+		fmt.Fprintln(cliErr, "config print:", err)
+		return 1
+	}
+	cliOut.Write(out)
+	if err := cfg.validate(true); err != nil {
+		fmt.Fprintf(cliErr, "invalid configuration:\n%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "forum.yaml")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+port: 6000
+upload_dir: /srv/uploads
+database:
+  url: postgres://forum@db/forum
+  max_open_conns: 10
+tokens:
+  session_ttl: 12h
+cors:
+  origins: [https://file.example]
+`)
+	t.Setenv("PORT", "7000")
+	t.Setenv("DB_MAX_OPEN_CONNS", "")
+	t.Setenv("CORS_ORIGINS", "https://env.example")
+	t.Setenv("FRONTEND_ORIGIN", "https://legacy.example")
+
+	c, rest, err := loadConfig([]string{"-config", path, "-port", "8000", "user", "set-role", "ada", "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rest, []string{"user", "set-role", "ada", "admin"}) {
+		t.Fatalf("rest = %q", rest)
+	}
+	if c.Port != 8000 {
+		t.Errorf("port = %d, want the flag's 8000", c.Port)
+	}
+	if c.UploadDir != "/srv/uploads" || c.Database.URL != "postgres://forum@db/forum" {
+		t.Errorf("file settings not applied: %+v", c)
+	}
+	if c.Database.MaxOpenConns != 10 {
+		t.Errorf("max_open_conns = %d; an empty variable should not override the file", c.Database.MaxOpenConns)
+	}
+	if c.Tokens.SessionTTL != 12*time.Hour || c.Tokens.EmailChangeTTL != 24*time.Hour {
+		t.Errorf("tokens = %+v", c.Tokens)
+	}
+	if want := []string{"https://env.example", "https://legacy.example"}; !slices.Equal(c.CORS.Origins, want) {
+		t.Errorf("origins = %q, want %q", c.CORS.Origins, want)
+	}
+
+	if _, _, err := loadConfig([]string{"-config", writeConfigFile(t, "prot: 1\n")}); err == nil {
+		t.Error("unknown key in config file was accepted")
+	}
+	t.Setenv("SESSION_TTL", "a day")
+	if _, _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "SESSION_TTL") {
+		t.Errorf("bad duration error = %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := defaultConfig()
+	c.Database.URL = "sqlite:forum.db"
+	if err := c.validate(false); err != nil {
+		t.Fatalf("admin commands need no JWT secret: %v", err)
+	}
+	if err := c.validate(true); err == nil {
+		t.Fatal("serving without a JWT secret was accepted")
+	}
+	c.JWTSecret = strings.Repeat("k", minSecretLen)
+	if err := c.validate(true); err != nil {
+		t.Fatal(err)
+	}
+
+	c.JWTSecret = "short"
+	c.Database.URL = "mysql://forum@db/forum"
+	c.PublicAPIURL = "api.example.com"
+	c.CookieSameSite = "sometimes"
+	c.CORS.Origins = []string{"https://ok.example", "https://bad.example/path"}
+	c.SMTP.Addr = "mail.example.com"
+	c.OIDC.Issuer = "https://id.example"
+	c.Log.Level = "loud"
+	c.Metrics.Addr = "9090"
+	c.Tracing.Exporter = "jaeger"
+	err := c.validate(true)
+	if err == nil {
+		t.Fatal("invalid config was accepted")
+	}
+	for _, want := range []string{"jwt_secret", "database.url", "public_api_url", "cookie_samesite", "cors.origins", "smtp.addr", "smtp.from", "oidc", "log.level", "metrics.addr", "tracing.exporter"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("no %s error in:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.JWTSecret = "super-secret-signing-key-0123456789"
+	c.Database.URL = "postgres://forum:dbpass@db/forum"
+	c.SMTP.Password = "smtppass"
+
+	out, err := configYAML(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{c.JWTSecret, "dbpass", "smtppass"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("config print leaked %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(string(out), "postgres://forum:xxxxx@db/forum") {
+		t.Errorf("database URL not shown redacted:\n%s", out)
+	}
+
+	// the printed file loads back
+	var back Config
+	if err := readConfigFile(&back, writeConfigFile(t, string(out))); err != nil {
+		t.Fatal(err)
+	}
+	if back.Tokens.SessionTTL != c.Tokens.SessionTTL || !slices.Equal(back.CORS.ExposeHeaders, c.CORS.ExposeHeaders) {
+		t.Errorf("round trip changed settings: %+v", back)
+	}
+
+	c.Database.URL = "host=db password=hunter2 dbname=forum"
+	if out, err = configYAML(&c); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "host=db password=xxxxx dbname=forum") {
+		t.Errorf("key=value DSN not redacted:\n%s", out)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// ---------- Content filter rules ----------
+//
+// Admins maintain words and regular expressions that are checked against
+// titles and content on create and edit. Plain words are matched whole-word
+// and case-insensitively through one Aho-Corasick automaton; the compiled rule
+// set is cached and rebuilt whenever the rules change. Other instances only
+// see the change on their next periodic reload.
+
+const (
+	filterReject  = "reject"
+	filterMask    = "mask"
+	filterApprove = "require_approval"
+)
+
+type FilterRule struct {
+	ID          int    `json:"id"`
+	Pattern     string `json:"pattern"`
+	IsRegex     bool   `json:"is_regex"`
+	Action      string `json:"action"`
+	Replacement string `json:"replacement"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type compiledFilter struct {
+	words   []FilterRule
+	ac      *acMatcher
+	regexes []FilterRule
+	res     []*regexp.Regexp
+}
+
+var contentFilter atomic.Pointer[compiledFilter]
+
+func compileFilter(rules []FilterRule) (*compiledFilter, error) {
+	cf := &compiledFilter{}
+	var words []string
+	for _, rule := range rules {
+		if rule.IsRegex {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			cf.regexes = append(cf.regexes, rule)
+			cf.res = append(cf.res, re)
+			continue
+		}
+		cf.words = append(cf.words, rule)
+		words = append(words, rule.Pattern)
+	}
+	cf.ac = newACMatcher(words)
+	return cf, nil
+}
+
+func loadFilterRules(ctx context.Context) ([]FilterRule, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, pattern, is_regex, action, replacement,
+			to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		FROM content_filters
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []FilterRule{}
+	for rows.Next() {
+		var fr FilterRule
+		if err := rows.Scan(&fr.ID, &fr.Pattern, &fr.IsRegex, &fr.Action, &fr.Replacement, &fr.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, fr)
+	}
+	return rules, rows.Err()
+}
+
+// reloadContentFilter rebuilds the cached matcher from the database.
+func reloadContentFilter(ctx context.Context) error {
+	rules, err := loadFilterRules(ctx)
+	if err != nil {
+		return err
+	}
+	cf, err := compileFilter(rules)
+	if err != nil {
+		return err
+	}
+	contentFilter.Store(cf)
+	return nil
+}
+
+// contentFilterLoop reloads the rules periodically, picking up changes made
+// through another instance.
+func contentFilterLoop(ctx context.Context, every time.Duration) {
+	runEvery(ctx, "content-filter-reload", every, false, func(ctx context.Context) {
+		if err := reloadContentFilter(ctx); err != nil {
+			slog.ErrorContext(ctx, "content filter reload failed", "err", err)
+		}
+	})
+}
+
+type filterHit struct {
+	rule       FilterRule
+	start, end int // rune offsets
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (cf *compiledFilter) hits(text string) ([]rune, []filterHit) {
+	runes := []rune(text)
+	var hits []filterHit
+
+	for _, m := range cf.ac.FindAll(runes) {
+		// whole words only, so "class" doesn't trip on "ass"
+		if m.Start > 0 && isWordRune(runes[m.Start-1]) {
+			continue
+		}
+		if m.End < len(runes) && isWordRune(runes[m.End]) {
+			continue
+		}
+		hits = append(hits, filterHit{cf.words[m.Pattern], m.Start, m.End})
+	}
+
+	if len(cf.res) > 0 {
+		// regexp offsets are bytes; map them to rune offsets
+		byteToRune := make(map[int]int, len(runes)+1)
+		ri := 0
+		for bi := range text {
+			byteToRune[bi] = ri
+			ri++
+		}
+		byteToRune[len(text)] = ri
+		for i, re := range cf.res {
+			for _, loc := range re.FindAllStringIndex(text, -1) {
+				if loc[0] == loc[1] {
+					continue
+				}
+				hits = append(hits, filterHit{cf.regexes[i], byteToRune[loc[0]], byteToRune[loc[1]]})
+			}
+		}
+	}
+	return runes, hits
+}
+
+type filterResult struct {
+	Text    string
+	Reject  bool
+	Approve bool // hold for moderator approval
+	Matched []string
+}
+
+// Apply checks text against all rules and returns the masked text along with
+// the strongest action triggered.
+func (cf *compiledFilter) Apply(text string) filterResult {
+	res := filterResult{Text: text}
+	if cf == nil {
+		return res
+	}
+	runes, hits := cf.hits(text)
+	if len(hits) == 0 {
+		return res
+	}
+
+	var masks []filterHit
+	for _, h := range hits {
+		res.Matched = append(res.Matched, h.rule.Pattern)
+		switch h.rule.Action {
+		case filterReject:
+			res.Reject = true
+		case filterApprove:
+			res.Approve = true
+		case filterMask:
+			masks = append(masks, h)
+		}
+	}
+	if len(masks) == 0 {
+		return res
+	}
+
+	// replace left to right, skipping hits that overlap one already masked
+	sort.Slice(masks, func(i, j int) bool { return masks[i].start < masks[j].start })
+	var b strings.Builder
+	pos := 0
+	for _, h := range masks {
+		if h.start < pos {
+			continue
+		}
+		b.WriteString(string(runes[pos:h.start]))
+		if h.rule.Replacement != "" {
+			b.WriteString(h.rule.Replacement)
+		} else {
+			b.WriteString(strings.Repeat("*", h.end-h.start))
+		}
+		pos = h.end
+	}
+	b.WriteString(string(runes[pos:]))
+	res.Text = b.String()
+	return res
+}
+
+// filterPost runs title and content through the rules. It writes a 422 and
+// returns ok=false when a reject rule matched; hold reports whether the post
+// has to wait for moderator approval.
+func filterPost(w http.ResponseWriter, title, content string) (newTitle, newContent string, hold, ok bool) {
+	cf := contentFilter.Load()
+	t := cf.Apply(title)
+	c := cf.Apply(content)
+	if t.Reject || c.Reject {
+		writeError(w, http.StatusUnprocessableEntity, "content_rejected", "Your post contains words that are not allowed here")
+		return "", "", false, false
+	}
+	return t.Text, c.Text, t.Approve || c.Approve, true
+}
+
+// ---------- /admin/content-filters ----------
+
+func validateFilterRule(fr *FilterRule) []FieldError {
+	var invalid []FieldError
+	fr.Pattern = strings.TrimSpace(fr.Pattern)
+	if fr.Pattern == "" {
+		invalid = append(invalid, FieldError{"pattern", "required", "is required"})
+	} else if fr.IsRegex {
+		if _, err := regexp.Compile(fr.Pattern); err != nil {
+			invalid = append(invalid, FieldError{"pattern", "invalid_regex", "invalid regex: " + err.Error()})
+		}
+	}
+	switch fr.Action {
+	case filterReject, filterMask, filterApprove:
+	default:
+		invalid = append(invalid, FieldError{"action", "invalid_choice", `must be "reject", "mask" or "require_approval"`})
+	}
+	return invalid
+}
+
+func contentFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := loadFilterRules(ctx)
+		if err != nil {
+			serverError(w, "FILTER LIST", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPost:
+		var fr FilterRule
+		if err := decodeJSON(r, &fr); err != nil {
+			badJSON(w, err)
+			return
+		}
+		if invalid := validateFilterRule(&fr); len(invalid) > 0 {
+			invalidFields(w, invalid...)
+			return
+		}
+
+		if err := db.QueryRowContext(ctx, `
+			INSERT INTO content_filters (pattern, is_regex, action, replacement, created_by)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		`, fr.Pattern, fr.IsRegex, fr.Action, fr.Replacement, getUserID(r)).Scan(&fr.ID, &fr.CreatedAt); err != nil {
+			serverError(w, "FILTER CREATE", err)
+			return
+		}
+		if err := reloadContentFilter(ctx); err != nil {
+			slog.ErrorContext(ctx, "content filter reload failed", "err", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(fr)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func contentFilterByIDHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var fr FilterRule
+		if err := decodeJSON(r, &fr); err != nil {
+			badJSON(w, err)
+			return
+		}
+		if invalid := validateFilterRule(&fr); len(invalid) > 0 {
+			invalidFields(w, invalid...)
+			return
+		}
+		fr.ID = id
+
+		if err := db.QueryRowContext(ctx, `
+			UPDATE content_filters SET pattern=$1, is_regex=$2, action=$3, replacement=$4
+			WHERE id=$5
+			RETURNING to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		`, fr.Pattern, fr.IsRegex, fr.Action, fr.Replacement, id).Scan(&fr.CreatedAt); err != nil {
+			writeError(w, 404, "rule_not_found", "Rule not found")
+			return
+		}
+		if err := reloadContentFilter(ctx); err != nil {
+			slog.ErrorContext(ctx, "content filter reload failed", "err", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(fr)
+
+	case http.MethodDelete:
+		res, err := db.ExecContext(ctx, `DELETE FROM content_filters WHERE id=$1`, id)
+		if err != nil {
+			serverError(w, "FILTER DELETE", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeError(w, 404, "rule_not_found", "Rule not found")
+			return
+		}
+		if err := reloadContentFilter(ctx); err != nil {
+			slog.ErrorContext(ctx, "content filter reload failed", "err", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+)
+
+// ---------- Cookie sessions ----------
+//
+// Instead of handing the token to JavaScript, login can put it in an HttpOnly
+// cookie. Cookies are sent automatically, so state-changing requests that
+// authenticate by cookie must also echo the CSRF cookie in X-CSRF-Token
+// (double submit). The CSRF value is derived from the session ID, so it can't
+// be planted by a sibling subdomain either.
+
+const (
+	sessionCookie = "webby_session"
+	csrfCookie    = "webby_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// cookieSameSite is the cookie_samesite setting (lax, strict or none).
+// "none" is only needed when the frontend and API are on different sites.
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+func csrfTokenFor(sid string) string {
+	return sign("csrf:" + sid)
+}
+
+// setSessionCookies stores token in the session cookie and returns the CSRF
+// token the client must send back.
+func setSessionCookies(w http.ResponseWriter, token string) (string, error) {
+	pl, err := parseToken(token)
+	if err != nil {
+		return "", err
+	}
+	csrf := csrfTokenFor(pl.SessionID)
+	maxAge := int(cfg.Tokens.SessionTTL.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/", MaxAge: maxAge,
+		HttpOnly: true, Secure: true, SameSite: cookieSameSite(),
+	})
+	// readable by the frontend when it shares the API's site; cross-site
+	// frontends use the csrf_token from the login response instead
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: csrf, Path: "/", MaxAge: maxAge,
+		Secure: true, SameSite: cookieSameSite(),
+	})
+	return csrf, nil
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name: name, Path: "/", MaxAge: -1,
+			HttpOnly: name == sessionCookie, Secure: true, SameSite: cookieSameSite(),
+		})
+	}
+}
+
+// csrfOK checks the double-submit token on unsafe requests.
+func csrfOK(r *http.Request, sid string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return false
+	}
+	header := r.Header.Get(csrfHeader)
+	return header != "" &&
+		hmac.Equal([]byte(header), []byte(c.Value)) &&
+		hmac.Equal([]byte(header), []byte(csrfTokenFor(sid)))
+}
+
+// ---------- POST /logout ----------
+//
+// Revokes the current session and clears the cookies. Works for bearer
+// sessions too; access tokens are revoked through /me/tokens instead.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if sid := getSessionID(r); sid != "" {
+		if err := store.RevokeSession(ctx, sid); err != nil {
+			serverError(w, "LOGOUT", err)
+			return
+		}
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ---------- CORS ----------
+//
+// The policy is built once at startup from the cors config section:
+//
+//	origins            CORS_ORIGINS, comma-separated; "https://*.example.com"
+//	                   allows any subdomain, "*" allows any origin
+//	                   (credentials are then never sent). FRONTEND_ORIGIN(_2)
+//	                   are still honoured and added.
+//	allow_credentials  CORS_ALLOW_CREDENTIALS, default true
+//	expose_headers     CORS_EXPOSE_HEADERS, default "Retry-After, Location"
+//	max_age            CORS_MAX_AGE, preflight cache in seconds, default 86400
+//
+// Methods and request headers are set per route in corsRoutes.
+
+type corsRoute struct {
+	Prefix  string
+	Methods []string
+	Headers []string
+	// NoCredentials turns credentials off for public, cookie-less routes.
+	NoCredentials bool
+}
+
+var (
+	corsDefaultMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	corsDefaultHeaders = []string{"Content-Type", "Authorization", csrfHeader}
+)
+
+// corsRoutes is matched by longest prefix; anything else gets the defaults.
+var corsRoutes = []corsRoute{
+	{Prefix: "/uploads/", Methods: []string{"GET", "HEAD"}, Headers: []string{}, NoCredentials: true},
+	{Prefix: "/auth/oidc/", Methods: []string{"GET"}, Headers: []string{}},
+	{Prefix: "/search", Methods: []string{"GET"}, Headers: []string{"Authorization"}},
+	{Prefix: "/users/", Methods: []string{"GET"}, Headers: []string{"Authorization"}},
+	{Prefix: "/email/confirm", Methods: []string{"GET"}, Headers: []string{}},
+	{Prefix: "/me/avatar", Methods: []string{"POST", "PUT"}, Headers: corsDefaultHeaders},
+}
+
+type corsPolicy struct {
+	exact       map[string]bool
+	wildcards   []corsWildcard
+	any         bool
+	credentials bool
+	expose      string
+	maxAge      string
+}
+
+type corsWildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+var corsConfig *corsPolicy
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// newCORSPolicy compiles the cors config section. It fails on origins that
+// aren't scheme://host[:port] or "*".
+func newCORSPolicy(c CORSConfig) (*corsPolicy, error) {
+	p := &corsPolicy{
+		exact:       map[string]bool{},
+		credentials: c.AllowCredentials,
+		expose:      strings.Join(c.ExposeHeaders, ", "),
+		maxAge:      strconv.Itoa(c.MaxAge),
+	}
+	for _, o := range c.Origins {
+		o = strings.TrimRight(o, "/")
+		if o == "*" {
+			p.any = true
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid origin %q", o)
+		}
+		if rest, ok := strings.CutPrefix(u.Hostname(), "*."); ok {
+			p.wildcards = append(p.wildcards, corsWildcard{scheme: u.Scheme, suffix: "." + strings.ToLower(rest), port: u.Port()})
+			continue
+		}
+		p.exact[strings.ToLower(o)] = true
+	}
+	return p, nil
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.any || p.exact[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, wc := range p.wildcards {
+		if u.Scheme == wc.scheme && u.Port() == wc.port && strings.HasSuffix(host, wc.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func routeFor(path string) corsRoute {
+	best := corsRoute{Methods: corsDefaultMethods, Headers: corsDefaultHeaders}
+	for _, rt := range corsRoutes {
+		if strings.HasPrefix(path, rt.Prefix) && len(rt.Prefix) > len(best.Prefix) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// preflightOK checks the requested method and headers against the route.
+func (rt corsRoute) preflightOK(r *http.Request) bool {
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method != "" && !slices.Contains(rt.Methods, method) {
+		return false
+	}
+	for _, h := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+		if !slices.ContainsFunc(rt.Headers, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := strings.TrimRight(r.Header.Get("Origin"), "/")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !corsConfig.allows(origin) {
+			writeError(w, http.StatusForbidden, "cors_origin_denied", "CORS blocked for origin: "+origin)
+			return
+		}
+
+		rt := routeFor(r.URL.Path)
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		// a "*" policy reflects the origin but never shares credentials
+		if corsConfig.credentials && !corsConfig.any && !rt.NoCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !rt.preflightOK(r) {
+				writeError(w, http.StatusForbidden, "cors_preflight_denied", "CORS preflight refused for "+r.URL.Path)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(append(slices.Clone(rt.Methods), "OPTIONS"), ", "))
+			if len(rt.Headers) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(rt.Headers, ", "))
+			}
+			h.Set("Access-Control-Max-Age", corsConfig.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if corsConfig.expose != "" {
+			h.Set("Access-Control-Expose-Headers", corsConfig.expose)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------- GET /debug-origin (admin) ----------
+//
+// Shows how the CORS policy treats the caller's Origin.
+func debugOriginHandler(w http.ResponseWriter, r *http.Request) {
+	origin := strings.TrimRight(r.Header.Get("Origin"), "/")
+	rt := routeFor(r.URL.Query().Get("path"))
+
+	exact := make([]string, 0, len(corsConfig.exact))
+	for o := range corsConfig.exact {
+		exact = append(exact, o)
+	}
+	slices.Sort(exact)
+	wildcards := make([]string, 0, len(corsConfig.wildcards))
+	for _, wc := range corsConfig.wildcards {
+		host := "*" + wc.suffix
+		if wc.port != "" {
+			host += ":" + wc.port
+		}
+		wildcards = append(wildcards, wc.scheme+"://"+host)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"origin":            origin,
+		"allowed":           corsConfig.allows(origin),
+		"origins":           exact,
+		"wildcards":         wildcards,
+		"any_origin":        corsConfig.any,
+		"credentials":       corsConfig.credentials,
+		"route_methods":     rt.Methods,
+		"route_headers":     rt.Headers,
+		"route_credentials": !rt.NoCredentials,
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ---------- Error responses ----------
+//
+// Every error is an RFC 7807 problem document. Code is the stable,
+// machine-readable part clients switch on; Detail is for humans and may
+// change. Internal errors are logged with the request ID and never shown.
+
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError points at one invalid input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const requestIDHeader = "X-Request-ID"
+
+const ctxRequestID ctxKey = "requestID"
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags each request with an ID, reusing a well-formed one from
+// the caller or a proxy so logs can be correlated across hops.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = randomToken(8)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxRequestID, id)))
+	})
+}
+
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxRequestID).(string)
+	return id
+}
+
+// writeProblem sends an error response. The request ID is taken from the
+// response header set by withRequestID, so helpers without the request can
+// report errors too.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	if p.Type == "" {
+		p.Type = "/errors/" + p.Code
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	p.RequestID = w.Header().Get(requestIDHeader)
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// writeError is the common case: a status, a stable code and a message.
+func writeError(w http.ResponseWriter, status int, code, detail string) {
+	writeProblem(w, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// invalidFields reports validation failures, one entry per field.
+func invalidFields(w http.ResponseWriter, fields ...FieldError) {
+	detail := "Some fields are invalid"
+	if len(fields) == 1 {
+		detail = fields[0].Field + " " + fields[0].Message
+	}
+	writeProblem(w, Problem{Status: http.StatusUnprocessableEntity, Code: "validation_failed", Detail: detail, Errors: fields})
+}
+
+// serverError logs err under label with the request ID and answers with a
+// generic 500.
+func serverError(w http.ResponseWriter, label string, err error) {
+	slog.Error("internal error", "op", label, "request_id", w.Header().Get(requestIDHeader), "err", err)
+	writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+}
+
+// badJSON turns a decodeJSON error into the matching problem.
+func badJSON(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+		return
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		writeProblem(w, Problem{
+			Status: http.StatusBadRequest, Code: "invalid_json", Detail: "Unknown field " + field,
+			Errors: []FieldError{{Field: field, Code: "unknown", Message: "Unknown field"}},
+		})
+		return
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		writeProblem(w, Problem{
+			Status: http.StatusBadRequest, Code: "invalid_json", Detail: typeErr.Field + " must be " + typeErr.Type.String(),
+			Errors: []FieldError{{Field: typeErr.Field, Code: "type", Message: "must be " + typeErr.Type.String()}},
+		})
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+}
+
+// methodNotAllowed is the fallthrough for handlers that switch on r.Method.
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// required appends a "required" error for name when v is blank.
+func required(invalid []FieldError, name, v string) []FieldError {
+	if strings.TrimSpace(v) == "" {
+		return append(invalid, FieldError{name, "required", "is required"})
+	}
+	return invalid
+}
+
+// muxErrors replaces the mux's own plain-text 404 and 405 replies with
+// problem documents.
+func muxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		infoFor(r).route = pattern
+		nameSpan(r, pattern)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&plainErrorWriter{ResponseWriter: w}, r)
+	})
+}
+
+type plainErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (pw *plainErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		writeError(pw.ResponseWriter, status, "not_found", "No such endpoint")
+	case http.StatusMethodNotAllowed:
+		methodNotAllowed(pw.ResponseWriter)
+	default:
+		pw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	pw.replaced = true
+}
+
+func (pw *plainErrorWriter) Write(b []byte) (int, error) {
+	if pw.replaced {
+		return len(b), nil
+	}
+	return pw.ResponseWriter.Write(b)
+}
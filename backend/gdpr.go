@@ -0,0 +1,425 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---------- Data export & account deletion ----------
+
+const (
+	exportRetention = 7 * 24 * time.Hour
+	// a job still pending or running after this long was lost, e.g. to a restart
+	exportTimeout = 30 * time.Minute
+	// authored content of anonymized accounts is moved to this placeholder
+	deletedUserEmail = "deleted-user@invalid"
+	deletedUserName  = "[deleted]"
+)
+
+type DataExport struct {
+	ID         string  `json:"id"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	FinishedAt *string `json:"finished_at"`
+}
+
+func exportPath(id string) string {
+	return filepath.Join(cfg.ExportDir, id+".zip")
+}
+
+// userUploads lists the files in the upload dir that belong to uid. Avatars are
+// saved as u<id>_<nanos>.<ext>, so the prefix identifies the owner.
+func userUploads(uid int) ([]string, error) {
+	return filepath.Glob(filepath.Join(cfg.UploadDir, fmt.Sprintf("u%d_*", uid)))
+}
+
+// queryRows returns each row as a column -> value map, which is all an export
+// needs and saves a struct per table.
+func queryRows(ctx context.Context, query string, args ...any) ([]map[string]any, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	out := []map[string]any{}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(cols))
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				row[c] = string(b)
+			} else {
+				row[c] = vals[i]
+			}
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+var exportQueries = []struct {
+	file  string
+	query string
+}{
+	{"profile.json", `SELECT id, username, email, display_name, bio, website, location, COALESCE(avatar_url, '') AS avatar_url,
+		role, trust_level, created_at, last_seen_at FROM users WHERE id=$1`},
+	{"topics.json", `SELECT id, title, content, status, created_at FROM topics WHERE user_id=$1 ORDER BY id`},
+	{"replies.json", `SELECT id, topic_id, content, status, created_at FROM replies WHERE user_id=$1 ORDER BY id`},
+	{"flags.json", `SELECT target_kind, target_id, reason, weight, created_at FROM flags WHERE user_id=$1 ORDER BY id`},
+	{"messages.json", `SELECT m.id, m.conversation_id, c.subject, m.content, m.created_at
+		FROM messages m JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.user_id=$1 ORDER BY m.id`},
+	{"conversations.json", `SELECT c.id, c.subject, c.created_at, p.joined_at, p.left_at
+		FROM conversation_participants p JOIN conversations c ON c.id = p.conversation_id
+		WHERE p.user_id=$1 ORDER BY c.id`},
+	{"blocks.json", `SELECT blocked_user_id, created_at FROM user_blocks WHERE user_id=$1`},
+	{"sessions.json", `SELECT created_at, expires_at, revoked_at, ip, user_agent FROM sessions WHERE user_id=$1 ORDER BY created_at`},
+	{"username_history.json", `SELECT old_username, changed_at FROM username_history WHERE user_id=$1`},
+	{"identities.json", `SELECT issuer, subject, email, created_at FROM user_identities WHERE user_id=$1`},
+	{"access_tokens.json", `SELECT name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at FROM access_tokens WHERE user_id=$1 ORDER BY id`},
+}
+
+func writeExportArchive(ctx context.Context, uid int, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, eq := range exportQueries {
+		rows, err := queryRows(ctx, eq.query, uid)
+		if err != nil {
+			return fmt.Errorf("%s: %w", eq.file, err)
+		}
+		var v any = rows
+		if eq.file == "profile.json" && len(rows) == 1 {
+			v = rows[0]
+		}
+		zf, err := zw.Create(eq.file)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(zf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	files, err := userUploads(uid)
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		zf, err := zw.Create("uploads/" + filepath.Base(p))
+		if err == nil {
+			_, err = io.Copy(zf, src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// runExport builds the archive as a background job. It outlives the request
+// that asked for it, so each statement gets its own query timeout instead.
+func runExport(ctx context.Context, id string, uid int) {
+	exec := func(query string, args ...any) error {
+		ctx, cancel := dbCtx(ctx)
+		defer cancel()
+		_, err := db.ExecContext(ctx, query, args...)
+		return err
+	}
+	if err := exec(`UPDATE data_exports SET status='running' WHERE id=$1`, id); err != nil {
+		slog.ErrorContext(ctx, "export failed", "export_id", id, "err", err)
+		return
+	}
+
+	err := os.MkdirAll(cfg.ExportDir, 0700)
+	if err == nil {
+		err = writeExportArchive(ctx, uid, exportPath(id))
+	}
+	if err != nil {
+		failSpan(ctx, err)
+		slog.ErrorContext(ctx, "export failed", "export_id", id, "user_id", uid, "err", err)
+		_ = os.Remove(exportPath(id))
+		_ = exec(`UPDATE data_exports SET status='failed', error=$1, finished_at=NOW() WHERE id=$2`,
+			"export failed", id)
+		return
+	}
+
+	// the row is gone if the export was swept or the account deleted while
+	// the archive was being written; nothing would ever serve or remove it
+	dctx, cancel := dbCtx(ctx)
+	defer cancel()
+	res, err := db.ExecContext(dctx, `UPDATE data_exports SET status='done', finished_at=NOW() WHERE id=$1`, id)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err != nil || n == 0 {
+		if err != nil {
+			slog.ErrorContext(ctx, "export failed", "export_id", id, "err", err)
+		}
+		_ = os.Remove(exportPath(id))
+	}
+}
+
+func loadExport(ctx context.Context, id string, uid int) (DataExport, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var e DataExport
+	err := db.QueryRowContext(ctx, `
+		SELECT id, status, error,
+			to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(finished_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		FROM data_exports WHERE id=$1 AND user_id=$2
+	`, id, uid).Scan(&e.ID, &e.Status, &e.Error, &e.CreatedAt, &e.FinishedAt)
+	return e, err
+}
+
+// exportSweepLoop deletes archives once they are past the retention window.
+func exportSweepLoop(ctx context.Context, every time.Duration) {
+	runEvery(ctx, "export-sweep", every, false, func(ctx context.Context) {
+		ctx, cancel := dbCtx(ctx)
+		defer cancel()
+		rows, err := db.QueryContext(ctx, `DELETE FROM data_exports WHERE created_at < $1 RETURNING id`, time.Now().Add(-exportRetention))
+		if err != nil {
+			slog.ErrorContext(ctx, "export sweep failed", "err", err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				_ = os.Remove(exportPath(id))
+			}
+		}
+	})
+}
+
+// ---------- POST /me/export ----------
+//
+// Starts building the archive in the background and returns the job. While a
+// job is still pending or running the same job is returned again, unless it
+// has been stuck for longer than exportTimeout; then it is marked failed and
+// a new one starts.
+func requestExportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	if _, err := db.ExecContext(ctx, `
+		UPDATE data_exports SET status='failed', error='export timed out', finished_at=NOW()
+		WHERE user_id=$1 AND status IN ('pending', 'running') AND created_at < $2
+	`, uid, time.Now().Add(-exportTimeout)); err != nil {
+		serverError(w, "EXPORT REQUEST", err)
+		return
+	}
+
+	var id string
+	err := db.QueryRowContext(ctx, `SELECT id FROM data_exports WHERE user_id=$1 AND status IN ('pending', 'running')`, uid).Scan(&id)
+	if err == sql.ErrNoRows {
+		id = randomToken(16)
+		if _, err := db.ExecContext(ctx, `INSERT INTO data_exports (id, user_id) VALUES ($1, $2)`, id, uid); err != nil {
+			serverError(w, "EXPORT REQUEST", err)
+			return
+		}
+		goJob(r.Context(), "export", func(ctx context.Context) { runExport(ctx, id, uid) })
+	} else if err != nil {
+		serverError(w, "EXPORT REQUEST", err)
+		return
+	}
+
+	e, err := loadExport(ctx, id, uid)
+	if err != nil {
+		serverError(w, "EXPORT REQUEST", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// ---------- GET /me/export/{id} ----------
+func exportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := loadExport(r.Context(), r.PathValue("id"), getUserID(r))
+	if err != nil {
+		writeError(w, 404, "export_not_found", "Export not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// ---------- GET /me/export/{id}/download ----------
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := loadExport(r.Context(), r.PathValue("id"), getUserID(r))
+	if err != nil {
+		writeError(w, 404, "export_not_found", "Export not found")
+		return
+	}
+	if e.Status != "done" {
+		writeError(w, http.StatusConflict, "export_not_ready", "Export is not ready yet")
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="webby-export-`+e.ID+`.zip"`)
+	http.ServeFile(w, r, exportPath(e.ID))
+}
+
+// deletedUserID returns the placeholder account that anonymized content is
+// attributed to. Migration 0012 creates it; its password hash can never match.
+func deletedUserID(ctx context.Context, tx *sql.Tx) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE is_system`).Scan(&id)
+	return id, err
+}
+
+// emailReserved reports whether email is the placeholder account's address,
+// which no real account may take.
+func emailReserved(email string) bool {
+	return normalizeEmail(email) == deletedUserEmail
+}
+
+// ---------- DELETE /me ----------
+//
+// mode "anonymize" (default) keeps topics, replies and messages but moves them
+// to the placeholder user; mode "delete" removes them.
+func deleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Password string `json:"password"`
+		Mode     string `json:"mode"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	if payload.Mode == "" {
+		payload.Mode = "anonymize"
+	}
+	if payload.Mode != "anonymize" && payload.Mode != "delete" {
+		invalidFields(w, FieldError{"mode", "invalid_choice", `must be "anonymize" or "delete"`})
+		return
+	}
+
+	var hash string
+	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id=$1`, uid).Scan(&hash); err != nil {
+		serverError(w, "ACCOUNT DELETE", err)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.Password)) != nil {
+		writeError(w, http.StatusForbidden, "wrong_password", "Password is incorrect")
+		return
+	}
+
+	var exportIDs []string
+	if rows, err := db.QueryContext(ctx, `SELECT id FROM data_exports WHERE user_id=$1`, uid); err == nil {
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				exportIDs = append(exportIDs, id)
+			}
+		}
+		rows.Close()
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "ACCOUNT DELETE", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var stmts []string
+	var args []any
+	if payload.Mode == "anonymize" {
+		placeholder, err := deletedUserID(ctx, tx)
+		if err != nil {
+			serverError(w, "ACCOUNT DELETE", err)
+			return
+		}
+		stmts = []string{
+			`UPDATE topics SET user_id=$2 WHERE user_id=$1`,
+			`UPDATE replies SET user_id=$2 WHERE user_id=$1`,
+			`UPDATE messages SET user_id=$2 WHERE user_id=$1`,
+		}
+		args = []any{uid, placeholder}
+	} else {
+		// replies to the user's topics go with them (ON DELETE CASCADE)
+		stmts = []string{
+			`DELETE FROM replies WHERE user_id=$1`,
+			`DELETE FROM topics WHERE user_id=$1`,
+		}
+		args = []any{uid}
+	}
+	for _, q := range stmts {
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			serverError(w, "ACCOUNT DELETE", err)
+			return
+		}
+	}
+	// sessions, flags, reads, blocks, remaining messages etc. cascade
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id=$1`, uid); err != nil {
+		serverError(w, "ACCOUNT DELETE", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, "ACCOUNT DELETE", err)
+		return
+	}
+
+	files, _ := userUploads(uid)
+	for _, p := range files {
+		if err := os.Remove(p); err != nil {
+			slog.ErrorContext(ctx, "account delete: removing upload failed", "user_id", uid, "err", err)
+		}
+	}
+	for _, id := range exportIDs {
+		_ = os.Remove(exportPath(id))
+	}
+	lastSeen.Delete(uid)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Handler tests run the real routes and middleware against the in-memory
+// store, and again against SQLite in TestSQLiteHandlers.
+
+func TestMain(m *testing.M) {
+	jwtSecret = []byte("test-secret")
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	corsConfig, _ = newCORSPolicy(cfg.CORS)
+	os.Exit(m.Run())
+}
+
+type testAPI struct {
+	t     *testing.T
+	h     http.Handler
+	store Store
+	mem   *memStore // nil when running against SQLite
+
+	// setTrustLevel pins a user's trust level.
+	setTrustLevel func(uid, level int)
+}
+
+// testOnSQLite makes newTestAPI use a fresh SQLite database instead of the
+// in-memory store; see TestSQLiteHandlers.
+var testOnSQLite bool
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	prev := store
+	t.Cleanup(func() { store = prev })
+	if testOnSQLite {
+		setTrustLevel := openTestSQLite(t)
+		return &testAPI{t: t, h: routes(), store: store, setTrustLevel: setTrustLevel}
+	}
+	mem := newMemStore()
+	store = mem
+	return &testAPI{t: t, h: routes(), store: mem, mem: mem, setTrustLevel: mem.setTrustLevel}
+}
+
+// do sends body (marshalled to JSON unless nil) with an optional bearer
+// token and returns the recorded response.
+func (a *testAPI) do(method, path, token string, body any, headers ...string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			a.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	a.h.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body)
+	}
+}
+
+func decodeBody[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+func expectProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) Problem {
+	t.Helper()
+	expectStatus(t, rec, status)
+	p := decodeBody[Problem](t, rec)
+	if p.Code != code {
+		t.Fatalf("problem code = %q, want %q", p.Code, code)
+	}
+	return p
+}
+
+// signup registers name and logs in, returning the user and a bearer token.
+func (a *testAPI) signup(name string) (User, string) {
+	a.t.Helper()
+	email := name + "@example.com"
+	rec := a.do("POST", "/register", "", map[string]string{"name": name, "email": email, "password": "hunter22"})
+	expectStatus(a.t, rec, http.StatusOK)
+
+	rec = a.do("POST", "/login", "", map[string]string{"email": email, "password": "hunter22"})
+	expectStatus(a.t, rec, http.StatusOK)
+	out := decodeBody[struct {
+		User  User   `json:"user"`
+		Token string `json:"token"`
+	}](a.t, rec)
+	if out.Token == "" {
+		a.t.Fatal("login returned no token")
+	}
+	return out.User, out.Token
+}
+
+// member signs up a user who is allowed to create topics.
+func (a *testAPI) member(name string) (User, string) {
+	u, tok := a.signup(name)
+	a.setTrustLevel(u.ID, trustBasic)
+	return u, tok
+}
+
+func (a *testAPI) createTopic(token, title, content string) Topic {
+	a.t.Helper()
+	rec := a.do("POST", "/topics", token, map[string]string{"title": title, "content": content})
+	expectStatus(a.t, rec, http.StatusOK)
+	return decodeBody[Topic](a.t, rec)
+}
+
+func TestRegister(t *testing.T) {
+	a := newTestAPI(t)
+
+	rec := a.do("POST", "/register", "", map[string]string{"name": "ada", "email": "ada@example.com", "password": "hunter22"})
+	expectStatus(t, rec, http.StatusOK)
+	u := decodeBody[User](t, rec)
+	if u.ID == 0 || u.Username != "ada" || u.Password != "" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	rec = a.do("POST", "/register", "", map[string]string{"name": "ada", "email": "other@example.com", "password": "x"})
+	expectProblem(t, rec, http.StatusConflict, "username_taken")
+
+	rec = a.do("POST", "/register", "", map[string]string{"name": "grace", "email": "ada@example.com", "password": "x"})
+	expectProblem(t, rec, http.StatusConflict, "email_taken")
+	rec = a.do("POST", "/register", "", map[string]string{"name": "grace", "email": " Ada@Example.COM", "password": "x"})
+	expectProblem(t, rec, http.StatusConflict, "email_taken")
+
+	// numeric names would be read as user IDs in /users/{ref}
+	rec = a.do("POST", "/register", "", map[string]string{"name": "1234", "email": "grace@example.com", "password": "x"})
+	expectProblem(t, rec, http.StatusUnprocessableEntity, "validation_failed")
+
+	// the anonymized-content placeholder's name and email can't be taken
+	rec = a.do("POST", "/register", "", map[string]string{"name": "[Deleted]", "email": "grace@example.com", "password": "x"})
+	expectProblem(t, rec, http.StatusConflict, "username_taken")
+	rec = a.do("POST", "/register", "", map[string]string{"name": "grace", "email": " Deleted-User@invalid", "password": "x"})
+	expectProblem(t, rec, http.StatusConflict, "email_taken")
+
+	rec = a.do("POST", "/register", "", map[string]string{"name": "grace"})
+	p := expectProblem(t, rec, http.StatusUnprocessableEntity, "validation_failed")
+	if len(p.Errors) != 2 || p.Errors[0].Field != "email" || p.Errors[1].Field != "password" {
+		t.Fatalf("field errors = %+v", p.Errors)
+	}
+
+	rec = a.do("POST", "/register", "", map[string]string{"name": "grace", "nickname": "g"})
+	expectProblem(t, rec, http.StatusBadRequest, "invalid_json")
+}
+
+func TestLogin(t *testing.T) {
+	a := newTestAPI(t)
+	a.signup("ada")
+
+	rec := a.do("POST", "/login", "", map[string]string{"email": "ada@example.com", "password": "wrong"})
+	expectProblem(t, rec, http.StatusUnauthorized, "invalid_credentials")
+
+	rec = a.do("POST", "/login", "", map[string]string{"email": "nobody@example.com", "password": "hunter22"})
+	expectProblem(t, rec, http.StatusUnauthorized, "invalid_credentials")
+
+	// emails are matched case-insensitively
+	rec = a.do("POST", "/login", "", map[string]string{"email": "ADA@example.com", "password": "hunter22"})
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	a := newTestAPI(t)
+	_, tok := a.member("ada")
+
+	expectStatus(t, a.do("POST", "/logout", tok, nil), http.StatusNoContent)
+	rec := a.do("POST", "/topics", tok, map[string]string{"title": "t", "content": "c"})
+	expectProblem(t, rec, http.StatusUnauthorized, "unauthorized")
+}
+
+func TestCookieSessionNeedsCSRF(t *testing.T) {
+	a := newTestAPI(t)
+	u, _ := a.signup("ada")
+	a.setTrustLevel(u.ID, trustBasic)
+
+	rec := a.do("POST", "/login", "", map[string]any{"email": "ada@example.com", "password": "hunter22", "cookie": true})
+	expectStatus(t, rec, http.StatusOK)
+	csrf := decodeBody[struct {
+		CSRF string `json:"csrf_token"`
+	}](t, rec).CSRF
+	var cookies []string
+	for _, c := range rec.Result().Cookies() {
+		cookies = append(cookies, c.Name+"="+c.Value)
+	}
+	if len(cookies) != 2 || csrf == "" {
+		t.Fatalf("cookies = %v, csrf = %q", cookies, csrf)
+	}
+	cookieHeader := cookies[0] + "; " + cookies[1]
+	body := map[string]string{"title": "t", "content": "c"}
+
+	rec = a.do("POST", "/topics", "", body, "Cookie", cookieHeader)
+	expectProblem(t, rec, http.StatusForbidden, "csrf_failed")
+
+	rec = a.do("POST", "/topics", "", body, "Cookie", cookieHeader, csrfHeader, csrf)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestTopicLifecycle(t *testing.T) {
+	a := newTestAPI(t)
+	ada, adaTok := a.member("ada")
+	_, bobTok := a.member("bob")
+
+	topic := a.createTopic(adaTok, "Hello", "First post")
+	if topic.UserID != ada.ID || topic.AuthorName != "ada" || topic.Status != "published" || topic.CreatedAt == "" {
+		t.Fatalf("unexpected topic %+v", topic)
+	}
+	a.createTopic(bobTok, "Second", "Another")
+
+	list := decodeBody[[]Topic](t, a.do("GET", "/topics", "", nil))
+	if len(list) != 2 || list[0].Title != "Second" || list[1].Title != "Hello" {
+		t.Fatalf("list = %+v", list)
+	}
+
+	path := fmt.Sprintf("/topics/%d", topic.ID)
+	got := decodeBody[Topic](t, a.do("GET", path, "", nil))
+	if got.Title != "Hello" {
+		t.Fatalf("get = %+v", got)
+	}
+
+	edit := map[string]string{"title": "Hello again", "content": "Edited"}
+	expectProblem(t, a.do("PUT", path, bobTok, edit), http.StatusForbidden, "forbidden")
+	expectProblem(t, a.do("PUT", path, "", edit), http.StatusUnauthorized, "unauthorized")
+
+	rec := a.do("PUT", path, adaTok, edit)
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeBody[Topic](t, rec); got.Title != "Hello again" || got.Content != "Edited" {
+		t.Fatalf("updated = %+v", got)
+	}
+
+	expectProblem(t, a.do("DELETE", path, bobTok, nil), http.StatusForbidden, "forbidden")
+	expectStatus(t, a.do("DELETE", path, adaTok, nil), http.StatusNoContent)
+	expectProblem(t, a.do("GET", path, "", nil), http.StatusNotFound, "topic_not_found")
+	expectProblem(t, a.do("DELETE", path, adaTok, nil), http.StatusNotFound, "topic_not_found")
+}
+
+func TestCreateTopicChecks(t *testing.T) {
+	a := newTestAPI(t)
+	_, tok := a.signup("newbie")
+
+	rec := a.do("POST", "/topics", "", map[string]string{"title": "t", "content": "c"})
+	expectProblem(t, rec, http.StatusUnauthorized, "unauthorized")
+
+	rec = a.do("POST", "/topics", tok, map[string]string{"title": "t", "content": "c"})
+	expectProblem(t, rec, http.StatusForbidden, "trust_level_too_low")
+
+	rec = a.do("POST", "/topics", tok, map[string]string{"title": " "})
+	p := expectProblem(t, rec, http.StatusUnprocessableEntity, "validation_failed")
+	if len(p.Errors) != 2 {
+		t.Fatalf("field errors = %+v", p.Errors)
+	}
+
+	expectProblem(t, a.do("GET", "/topics/abc", "", nil), http.StatusBadRequest, "invalid_id")
+}
+
+func TestHeldTopicsAreHidden(t *testing.T) {
+	a := newTestAPI(t)
+	ada, _ := a.member("ada")
+	held, err := a.store.CreateTopic(t.Context(), ada.ID, "Buy now", "cheap stuff", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list := decodeBody[[]Topic](t, a.do("GET", "/topics", "", nil)); len(list) != 0 {
+		t.Fatalf("held topic listed: %+v", list)
+	}
+	if list := decodeBody[[]Topic](t, a.do("GET", "/search?q=cheap", "", nil)); len(list) != 0 {
+		t.Fatalf("held topic found by search: %+v", list)
+	}
+	expectProblem(t, a.do("GET", fmt.Sprintf("/topics/%d", held.ID), "", nil), http.StatusNotFound, "topic_not_found")
+}
+
+// Editing a held or rejected post must not publish it.
+func TestEditKeepsModerationStatus(t *testing.T) {
+	a := newTestAPI(t)
+	ada, tok := a.member("ada")
+	topic := a.createTopic(tok, "Hello", "First post")
+	for _, status := range []string{"pending", "rejected"} {
+		held, err := a.store.CreateTopic(t.Context(), ada.ID, "Buy now", "cheap stuff", status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := a.do("PUT", fmt.Sprintf("/topics/%d", held.ID), tok, map[string]string{"title": "Buy now", "content": "it's fine really"})
+		if got := decodeBody[Topic](t, rec); got.Status != status {
+			t.Errorf("edited %s topic is %q", status, got.Status)
+		}
+
+		reply, err := a.store.CreateReply(t.Context(), ada.ID, topic.ID, "cheap stuff", status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec = a.do("PUT", fmt.Sprintf("/replies/%d", reply.ID), tok, map[string]string{"content": "it's fine really"})
+		if got := decodeBody[Reply](t, rec); got.Status != status {
+			t.Errorf("edited %s reply is %q", status, got.Status)
+		}
+	}
+	if list := decodeBody[[]Topic](t, a.do("GET", "/topics", "", nil)); len(list) != 1 {
+		t.Fatalf("topics = %+v", list)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	a := newTestAPI(t)
+	_, adaTok := a.member("ada")
+	_, bobTok := a.member("bob")
+	topic := a.createTopic(adaTok, "Hello", "First post")
+
+	rec := a.do("POST", "/replies", bobTok, map[string]any{"topic_id": topic.ID, "content": "Welcome!"})
+	expectStatus(t, rec, http.StatusOK)
+	reply := decodeBody[Reply](t, rec)
+	if reply.TopicID != topic.ID || reply.AuthorName != "bob" || reply.Status != "published" {
+		t.Fatalf("reply = %+v", reply)
+	}
+	a.do("POST", "/replies", adaTok, map[string]any{"topic_id": topic.ID, "content": "Thanks"})
+
+	list := decodeBody[[]Reply](t, a.do("GET", fmt.Sprintf("/replies?topic_id=%d", topic.ID), "", nil))
+	if len(list) != 2 || list[0].Content != "Welcome!" || list[1].Content != "Thanks" {
+		t.Fatalf("replies = %+v", list)
+	}
+	if got := decodeBody[Topic](t, a.do("GET", fmt.Sprintf("/topics/%d", topic.ID), "", nil)); got.ReplyCount != 2 {
+		t.Fatalf("reply_count = %d, want 2", got.ReplyCount)
+	}
+
+	rec = a.do("POST", "/replies", bobTok, map[string]any{"topic_id": 9999, "content": "lost"})
+	expectProblem(t, rec, http.StatusNotFound, "topic_not_found")
+	rec = a.do("POST", "/replies", bobTok, map[string]any{"content": "no topic"})
+	expectProblem(t, rec, http.StatusUnprocessableEntity, "validation_failed")
+	expectProblem(t, a.do("GET", "/replies?topic_id=x", "", nil), http.StatusBadRequest, "invalid_topic_id")
+
+	path := fmt.Sprintf("/replies/%d", reply.ID)
+	expectProblem(t, a.do("PUT", path, adaTok, map[string]string{"content": "hijack"}), http.StatusForbidden, "forbidden")
+	rec = a.do("PUT", path, bobTok, map[string]string{"content": "Welcome aboard!"})
+	expectStatus(t, rec, http.StatusOK)
+
+	expectProblem(t, a.do("DELETE", path, adaTok, nil), http.StatusForbidden, "forbidden")
+	expectStatus(t, a.do("DELETE", path, bobTok, nil), http.StatusNoContent)
+	expectProblem(t, a.do("DELETE", path, bobTok, nil), http.StatusNotFound, "reply_not_found")
+
+	list = decodeBody[[]Reply](t, a.do("GET", fmt.Sprintf("/replies?topic_id=%d", topic.ID), "", nil))
+	if len(list) != 1 || list[0].Content != "Thanks" {
+		t.Fatalf("replies after delete = %+v", list)
+	}
+}
+
+func TestDeleteTopicRemovesReplies(t *testing.T) {
+	a := newTestAPI(t)
+	_, tok := a.member("ada")
+	topic := a.createTopic(tok, "Hello", "First post")
+	rec := a.do("POST", "/replies", tok, map[string]any{"topic_id": topic.ID, "content": "reply"})
+	reply := decodeBody[Reply](t, rec)
+
+	expectStatus(t, a.do("DELETE", fmt.Sprintf("/topics/%d", topic.ID), tok, nil), http.StatusNoContent)
+	expectProblem(t, a.do("DELETE", fmt.Sprintf("/replies/%d", reply.ID), tok, nil), http.StatusNotFound, "reply_not_found")
+}
+
+func TestSearch(t *testing.T) {
+	a := newTestAPI(t)
+	_, adaTok := a.member("ada")
+	_, bobTok := a.member("bob")
+	a.createTopic(adaTok, "Gardening tips", "Tomatoes need sun")
+	a.createTopic(bobTok, "Bikes", "Which GARDEN path is best to ride?")
+	a.createTopic(bobTok, "Cooking", "Pasta")
+
+	cases := map[string]int{"garden": 2, "tomatoes": 1, "BOB": 2, "nothing": 0}
+	for q, want := range cases {
+		list := decodeBody[[]Topic](t, a.do("GET", "/search?q="+q, "", nil))
+		if len(list) != want {
+			t.Errorf("search %q: %d results, want %d", q, len(list), want)
+		}
+	}
+	if body := a.do("GET", "/search?q=", "", nil).Body.String(); body != "[]\n" {
+		t.Errorf("empty query body = %q", body)
+	}
+}
+
+func TestReadingRaisesTrustLevel(t *testing.T) {
+	a := newTestAPI(t)
+	ada, adaTok := a.member("ada")
+	bob, bobTok := a.signup("bob")
+
+	var ids []int
+	for i := range 3 {
+		ids = append(ids, a.createTopic(adaTok, fmt.Sprintf("Topic %d", i), "body").ID)
+	}
+	for _, id := range ids {
+		expectStatus(t, a.do("GET", fmt.Sprintf("/topics/%d", id), bobTok, nil), http.StatusOK)
+	}
+
+	// bob is too new for level 1 until the account is old enough
+	a.mem.now = func() time.Time { return bob.CreatedAt.Add(time.Hour) }
+	if err := store.RefreshTrustLevel(t.Context(), bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	level, _, _ := store.UserAccess(t.Context(), bob.ID)
+	if level != trustBasic {
+		t.Fatalf("bob's trust level = %d, want %d", level, trustBasic)
+	}
+
+	// pinned levels are left alone
+	if err := store.RefreshTrustLevel(t.Context(), ada.ID); err != nil {
+		t.Fatal(err)
+	}
+	if level, _, _ := store.UserAccess(t.Context(), ada.ID); level != trustBasic {
+		t.Fatalf("ada's pinned trust level changed to %d", level)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ---------- Health, readiness & version ----------
+//
+// Probes for the orchestrator. They are mounted in front of the API's
+// middleware chain, so CORS, body limits, access logs and tracing never
+// apply to them and a probe can't be refused or flood the logs.
+//
+// /healthz only says the process is serving. /readyz runs every check
+// concurrently, each with its own timeout, and answers 503 when a required
+// one fails; optional ones (mail, identity provider, Akismet) are reported
+// but don't take the instance out of rotation. Results are reused for
+// readyCacheTTL, so frequent or concurrent probes share one run.
+
+// Build metadata, set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// commit and buildTime fall back to the VCS stamp Go embeds in the binary.
+var (
+	version   = "dev"
+	commit    string
+	buildTime string
+)
+
+const (
+	readyCheckTimeout = 2 * time.Second
+	readyCacheTTL     = 2 * time.Second
+)
+
+type readyCheck struct {
+	Name     string
+	Optional bool
+	Run      func(ctx context.Context) error
+}
+
+// checkResult is what /readyz shows for a check. The endpoint is public, so
+// why a check failed only goes to the log.
+type checkResult struct {
+	Status     string  `json:"status"` // ok or error
+	Optional   bool    `json:"optional,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// withProbes serves the probe endpoints and hands everything else to api.
+func withProbes(api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.Handle("/", api)
+	return mux
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	results, ready := cachedReadiness(r.Context())
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": results})
+}
+
+// readyChecks lists what this instance depends on, given its configuration.
+func readyChecks() []readyCheck {
+	checks := []readyCheck{
+		{Name: "database", Run: func(ctx context.Context) error { return db.PingContext(ctx) }},
+		{Name: "migrations", Run: checkMigrations},
+		{Name: "upload_dir", Run: func(context.Context) error { return checkWritable(cfg.UploadDir) }},
+	}
+	if cfg.SMTP.Addr != "" {
+		checks = append(checks, readyCheck{Name: "smtp", Optional: true, Run: func(ctx context.Context) error {
+			return checkDial(ctx, cfg.SMTP.Addr)
+		}})
+	}
+	if oidcProvider != nil {
+		checks = append(checks, readyCheck{Name: "oidc", Optional: true, Run: func(ctx context.Context) error {
+			_, err := oidcProvider.discovery(ctx)
+			return err
+		}})
+	}
+	if cfg.Spam.AkismetKey != "" {
+		checks = append(checks, readyCheck{Name: "akismet", Optional: true, Run: func(ctx context.Context) error {
+			u, err := url.Parse(cfg.Spam.AkismetURL)
+			if err != nil {
+				return err
+			}
+			port := u.Port()
+			if port == "" {
+				port = "443"
+				if u.Scheme == "http" {
+					port = "80"
+				}
+			}
+			return checkDial(ctx, net.JoinHostPort(u.Hostname(), port))
+		}})
+	}
+	return checks
+}
+
+// readyCache holds the last /readyz run. The lock is held while the checks
+// run, so probes arriving meanwhile wait for that run instead of starting
+// their own.
+var readyCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	results map[string]checkResult
+	ready   bool
+}
+
+func cachedReadiness(ctx context.Context) (map[string]checkResult, bool) {
+	readyCache.mu.Lock()
+	defer readyCache.mu.Unlock()
+	if time.Since(readyCache.at) >= readyCacheTTL {
+		// the result is shared, so one probe hanging up mustn't fail it
+		readyCache.results, readyCache.ready = runReadyChecks(context.WithoutCancel(ctx), readyChecks())
+		readyCache.at = time.Now()
+	}
+	return readyCache.results, readyCache.ready
+}
+
+// runReadyChecks runs the checks concurrently and reports whether every
+// required one passed.
+func runReadyChecks(ctx context.Context, checks []readyCheck) (map[string]checkResult, bool) {
+	results := make(map[string]checkResult, len(checks))
+	ready := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := runCheck(ctx, c.Run)
+			res := checkResult{Status: "ok", Optional: c.Optional, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				res.Status = "error"
+				slog.WarnContext(ctx, "readiness check failed", "check", c.Name, "optional", c.Optional, "err", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[c.Name] = res
+			if err != nil && !c.Optional {
+				ready = false
+			}
+		})
+	}
+	wg.Wait()
+	return results, ready
+}
+
+// runCheck gives up on a check that ignores its context once the timeout
+// has passed; the check itself finishes in the background.
+func runCheck(ctx context.Context, run func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() { done <- run(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func checkMigrations(ctx context.Context) error {
+	all, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, m := range all {
+		if applied[m.Version] == "" {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d pending migration(s)", pending)
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	return errors.Join(f.Close(), os.Remove(f.Name()))
+}
+
+func checkDial(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildTime == "":
+				b.BuildTime = s.Value
+			}
+		}
+	}
+	return b
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentBuild())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbes(t *testing.T) {
+	testOnSQLite = true
+	defer func() { testOnSQLite = false }()
+	a := newTestAPI(t)
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	cfg.UploadDir = t.TempDir()
+	readyCache.at = time.Time{}
+	t.Cleanup(func() { readyCache.at = time.Time{} })
+
+	expectStatus(t, a.do("GET", "/healthz", "", nil), http.StatusOK)
+	v := decodeBody[buildInfo](t, a.do("GET", "/version", "", nil))
+	if v.Version != version || v.GoVersion == "" {
+		t.Errorf("version = %+v", v)
+	}
+
+	type readiness struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}
+	// probes skip the CORS check, so an unknown origin isn't refused
+	rec := a.do("GET", "/readyz", "", nil, "Origin", "https://elsewhere.example")
+	expectStatus(t, rec, http.StatusOK)
+	ready := decodeBody[readiness](t, rec)
+	for _, name := range []string{"database", "migrations", "upload_dir"} {
+		if ready.Checks[name].Status != "ok" {
+			t.Errorf("%s check = %+v", name, ready.Checks[name])
+		}
+	}
+
+	// results are reused for a moment
+	cfg.UploadDir = filepath.Join(t.TempDir(), "missing")
+	expectStatus(t, a.do("GET", "/readyz", "", nil), http.StatusOK)
+	readyCache.at = time.Time{}
+
+	// a missing directory is a failure, not something to create
+	expectStatus(t, a.do("GET", "/readyz", "", nil), http.StatusServiceUnavailable)
+	if _, err := os.Stat(cfg.UploadDir); !os.IsNotExist(err) {
+		t.Errorf("readiness created %s: %v", cfg.UploadDir, err)
+	}
+	cfg.UploadDir = t.TempDir()
+	readyCache.at = time.Time{}
+
+	// an unreachable optional dependency is reported but not fatal
+	cfg.SMTP.Addr = "127.0.0.1:1"
+	rec = a.do("GET", "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if smtp := decodeBody[readiness](t, rec).Checks["smtp"]; smtp.Status != "error" || !smtp.Optional {
+		t.Errorf("smtp check = %+v", smtp)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.UploadDir = filepath.Join(file, "uploads")
+	readyCache.at = time.Time{}
+	rec = a.do("GET", "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if strings.Contains(rec.Body.String(), file) {
+		t.Errorf("readiness leaks error details: %s", rec.Body)
+	}
+	if ready := decodeBody[readiness](t, rec); ready.Status != "unavailable" || ready.Checks["upload_dir"].Status != "error" {
+		t.Errorf("readiness = %+v", ready)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------- Logging ----------
+//
+// Logs go through log/slog, one JSON object per line unless LOG_FORMAT=text.
+// Records logged with a request's context (slog.ErrorContext and friends)
+// carry its request ID, and every request ends with an access log line, so
+// everything a request did can be found by filtering on request_id.
+
+// newLogger builds the process logger from validated settings.
+func newLogger(c LogConfig, w io.Writer) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(c.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(w, opts)
+	if c.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// contextHandler adds the request and trace IDs from the record's context.
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id, ok := ctx.Value(ctxRequestID).(string); ok {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestInfo is filled in while a request is handled: muxErrors records the
+// matched route and requireAuth the user, for the access log and the
+// request's span to report. withRequestInfo attaches it outside both.
+type requestInfo struct {
+	route  string
+	userID int
+}
+
+const ctxRequestInfo ctxKey = "requestInfo"
+
+func infoFor(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(ctxRequestInfo).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{} // outside withRequestInfo, e.g. in handler tests
+}
+
+func withRequestInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxRequestInfo, &requestInfo{})))
+	})
+}
+
+// accessLog writes one line per request once it has been answered and
+// records it in the HTTP metrics.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		info := infoFor(r)
+
+		took := time.Since(start)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		observeRequest(r.Method, info.route, sw.status, took)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", info.route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Float64("duration_ms", float64(took.Microseconds())/1000),
+		}
+		if info.userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userID))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// statusWriter remembers the status and counts the body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// fatal logs a startup or serving failure and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
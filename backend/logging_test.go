@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	a := newTestAPI(t)
+	_, tok := a.signup("ada")
+
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(newLogger(LogConfig{Level: "info", Format: "json"}, &buf))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	rec := a.do("POST", "/logout", tok, nil, "X-Request-ID", "req-42")
+	if got := rec.Header().Get(requestIDHeader); got != "req-42" {
+		t.Fatalf("request ID = %q, want the caller's", got)
+	}
+
+	var line struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		Method    string `json:"method"`
+		Route     string `json:"route"`
+		Status    int    `json:"status"`
+		UserID    int    `json:"user_id"`
+	}
+	out := strings.TrimSpace(buf.String())
+	if err := json.Unmarshal([]byte(out[strings.LastIndexByte(out, '\n')+1:]), &line); err != nil {
+		t.Fatalf("access log is not JSON: %v\n%s", err, out)
+	}
+	if line.Msg != "request" || line.RequestID != "req-42" || line.Method != "POST" ||
+		line.Route != "POST /logout" || line.Status != rec.Code || line.UserID == 0 {
+		t.Errorf("access log = %+v", line)
+	}
+
+	buf.Reset()
+	slog.SetDefault(newLogger(LogConfig{Level: "warn", Format: "text"}, &buf))
+	a.do("GET", "/topics", "", nil)
+	if buf.Len() != 0 {
+		t.Errorf("info line logged at warn level: %s", buf.String())
+	}
+}
+
+func TestLogMailerHidesLinks(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(newLogger(LogConfig{Level: "info", Format: "text"}, &buf))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	_ = logMailer{}.Send("ada@example.com", "Confirm", "Open https://forum.test/confirm?token=s3cret within a day.")
+	if out := buf.String(); strings.Contains(out, "s3cret") || !strings.Contains(out, "ada@example.com") {
+		t.Errorf("logged %s", out)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---------- Login throttling ----------
+//
+// Failed logins are tracked per account (normalized email) and per client IP.
+// After a few free attempts every further failure doubles the wait before the
+// next attempt is accepted; enough failures on one account lock it for a while
+// and the owner gets an email about it.
+
+const (
+	loginFreeAttempts     = 3
+	loginBaseDelay        = 1 * time.Second
+	loginMaxDelay         = 15 * time.Minute
+	accountLockThreshold  = 10
+	accountLockDuration   = 30 * time.Minute
+	ipFreeAttempts        = 20
+	loginAttemptRetention = 24 * time.Hour
+)
+
+type attemptState struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+}
+
+type loginGuard struct {
+	mu       sync.Mutex
+	accounts map[string]*attemptState
+	ips      map[string]*attemptState
+	now      func() time.Time
+}
+
+var logins = newLoginGuard()
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{
+		accounts: map[string]*attemptState{},
+		ips:      map[string]*attemptState{},
+		now:      time.Now,
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// backoff returns how long to block after the given number of failures.
+func backoff(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	d := loginBaseDelay
+	for i := free; i < failures; i++ {
+		d *= 2
+		if d >= loginMaxDelay {
+			return loginMaxDelay
+		}
+	}
+	return d
+}
+
+// reserve claims a login attempt for this email/IP pair. While either is
+// blocked it returns how long the caller has to wait and records nothing.
+// Otherwise the attempt is counted as a failure right away, under the same
+// lock as the check, so concurrent requests can't all get through on one
+// check; succeed or refund takes it back. lockedNow is true when this attempt
+// pushed the account into a lockout, so the caller can notify the owner
+// exactly once if it really fails.
+func (g *loginGuard) reserve(email, ip string) (wait time.Duration, lockedNow bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for _, st := range []*attemptState{g.accounts[email], g.ips[ip]} {
+		if st == nil {
+			continue
+		}
+		if d := st.blockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	acc := g.accounts[email]
+	if acc == nil {
+		acc = &attemptState{}
+		g.accounts[email] = acc
+	}
+	acc.failures++
+	acc.lastFailure = now
+	if acc.failures >= accountLockThreshold {
+		acc.blockedUntil = now.Add(accountLockDuration)
+		if !acc.locked {
+			acc.locked = true
+			lockedNow = true
+		}
+	} else {
+		acc.blockedUntil = now.Add(backoff(acc.failures, loginFreeAttempts))
+	}
+
+	st := g.ips[ip]
+	if st == nil {
+		st = &attemptState{}
+		g.ips[ip] = st
+	}
+	st.failures++
+	st.lastFailure = now
+	st.blockedUntil = now.Add(backoff(st.failures, ipFreeAttempts))
+
+	return 0, lockedNow
+}
+
+// succeed takes back a reserved attempt that got the password right and
+// clears the account's failure history. The rest of the IP history is kept
+// so a single valid account cannot be used to reset a spraying client.
+func (g *loginGuard) succeed(email, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.accounts, email)
+	g.forget(g.ips, ip, ipFreeAttempts)
+}
+
+// refund takes back a reserved attempt that never got to check the
+// password, e.g. because the database was unavailable.
+func (g *loginGuard) refund(email, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.forget(g.accounts, email, loginFreeAttempts)
+	g.forget(g.ips, ip, ipFreeAttempts)
+}
+
+// forget drops one failure from m[key] and recomputes its block from the
+// failures that are left. The caller holds g.mu.
+func (g *loginGuard) forget(m map[string]*attemptState, key string, free int) {
+	st := m[key]
+	if st == nil {
+		return
+	}
+	st.failures--
+	if st.locked && st.failures < accountLockThreshold {
+		st.locked = false
+	}
+	switch {
+	case st.failures <= 0:
+		delete(m, key)
+	case st.locked:
+		// the lock runs its full course
+	default:
+		st.blockedUntil = st.lastFailure.Add(backoff(st.failures, free))
+	}
+}
+
+// sweep drops entries whose last failure is older than the retention window.
+func (g *loginGuard) sweep() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cutoff := g.now().Add(-loginAttemptRetention)
+	for _, m := range []map[string]*attemptState{g.accounts, g.ips} {
+		for k, st := range m {
+			if st.lastFailure.Before(cutoff) && st.blockedUntil.Before(g.now()) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+func (g *loginGuard) sweepLoop(ctx context.Context, every time.Duration) {
+	runEvery(ctx, "login-guard-sweep", every, false, func(context.Context) { g.sweep() })
+}
+
+// dummyHash is compared against when the email is unknown so that a miss
+// costs the same bcrypt work as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("webby-dummy-password"), bcrypt.DefaultCost)
+
+// clientIP returns the caller's address. X-Forwarded-For is only honoured when
+// trust_proxy is set, otherwise any client could pick its own IP. Even then
+// only the entries our own proxies appended count: each of the proxy_hops
+// proxies adds the address it received the request from, so the client is
+// proxy_hops entries from the right and anything further left is whatever
+// the client chose to send.
+func clientIP(r *http.Request) string {
+	if cfg.TrustProxy {
+		var hops []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(h, ",")...)
+		}
+		if len(hops) > 0 {
+			return strings.TrimSpace(hops[max(len(hops)-cfg.ProxyHops, 0)])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func notifyLockout(ctx context.Context, email, ip string) {
+	sendMailAsync(ctx, email, "Your Webby account was temporarily locked",
+		"We saw too many failed sign-in attempts on your account and locked it for "+
+			accountLockDuration.String()+".\n\n"+
+			"Last attempt came from IP "+ip+".\n"+
+			"If this wasn't you, consider choosing a stronger password once the lock expires.")
+}
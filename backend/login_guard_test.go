@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardReserve(t *testing.T) {
+	g := newLoginGuard()
+	now := time.Unix(1_700_000_000, 0)
+	g.now = func() time.Time { return now }
+
+	// concurrent attempts can't all pass on one check
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+	for range 20 {
+		wg.Go(func() {
+			if wait, _ := g.reserve("ada@example.com", "203.0.113.7"); wait == 0 {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if passed != loginFreeAttempts {
+		t.Fatalf("%d concurrent attempts passed, want %d", passed, loginFreeAttempts)
+	}
+
+	// a correct password takes its attempt back and clears the account
+	g.succeed("ada@example.com", "203.0.113.7")
+	if wait, _ := g.reserve("ada@example.com", "203.0.113.7"); wait != 0 {
+		t.Fatalf("blocked for %v after a successful login", wait)
+	}
+
+	// the attempt that locks the account reports it once; a refunded one
+	// lifts the lock again
+	g = newLoginGuard()
+	g.now = func() time.Time { return now }
+	var locked int
+	for i := range accountLockThreshold {
+		now = now.Add(loginMaxDelay)
+		wait, lockedNow := g.reserve("bob@example.com", fmt.Sprint("198.51.100.", i))
+		if wait != 0 {
+			t.Fatalf("attempt %d blocked for %v", i+1, wait)
+		}
+		if lockedNow {
+			locked++
+		}
+	}
+	if locked != 1 {
+		t.Fatalf("lockout reported %d times", locked)
+	}
+	if wait, _ := g.reserve("bob@example.com", "192.0.2.9"); wait != accountLockDuration {
+		t.Fatalf("locked account waits %v", wait)
+	}
+	g.refund("bob@example.com", "198.51.100.9")
+	if wait, _ := g.reserve("bob@example.com", "192.0.2.9"); wait >= accountLockDuration {
+		t.Fatalf("refunded lock still blocks for %v", wait)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+
+	tests := []struct {
+		trust bool
+		hops  int
+		xff   []string
+		want  string
+	}{
+		{false, 1, []string{"203.0.113.7"}, "192.0.2.1"},
+		{true, 1, nil, "192.0.2.1"},
+		{true, 1, []string{"203.0.113.7"}, "203.0.113.7"},
+		// a client can't pick its IP by sending its own header first
+		{true, 1, []string{"10.9.9.9, 203.0.113.7"}, "203.0.113.7"},
+		{true, 1, []string{"10.9.9.9", "203.0.113.7"}, "203.0.113.7"},
+		{true, 2, []string{"10.9.9.9, 203.0.113.7, 198.51.100.2"}, "203.0.113.7"},
+		{true, 3, []string{"203.0.113.7"}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		cfg.TrustProxy, cfg.ProxyHops = tt.trust, tt.hops
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("trust=%v hops=%d xff=%q: clientIP = %q, want %q", tt.trust, tt.hops, tt.xff, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Mailer delivers plain-text notification emails to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer = logMailer{}
+
+// logMailer is used when no SMTP server is configured: mails are only logged,
+// which keeps local development free of extra setup. Links are left out of
+// the log since they carry confirmation and reset tokens.
+type logMailer struct{}
+
+var mailLinkRe = regexp.MustCompile(`https?://\S+`)
+
+func (logMailer) Send(to, subject, body string) error {
+	slog.Info("mail not sent, SMTP_ADDR unset", "to", to, "subject", subject,
+		"body", mailLinkRe.ReplaceAllString(body, "[link removed]"))
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m smtpMailer) Send(to, subject, body string) error {
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// newMailer returns an SMTP mailer when smtp.addr is set, otherwise a mailer
+// that only logs.
+func newMailer(c SMTPConfig) (Mailer, error) {
+	if c.Addr == "" {
+		return logMailer{}, nil
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad smtp.addr: %w", err)
+	}
+
+	m := smtpMailer{addr: c.Addr, from: c.From}
+	if c.Username != "" {
+		m.auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return m, nil
+}
+
+// sendMailAsync sends in the background so request latency never depends on
+// the mail server.
+func sendMailAsync(ctx context.Context, to, subject, body string) {
+	goJob(ctx, "mail", func(ctx context.Context) {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("mail.subject", subject))
+		if err := mailer.Send(to, subject, body); err != nil {
+			failSpan(ctx, err)
+			slog.ErrorContext(ctx, "mail send failed", "to", to, "subject", subject, "err", err)
+		}
+	})
+}
@@ -7,9 +7,10 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,7 +18,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
@@ -36,6 +36,7 @@ type Topic struct {
 	AuthorAvatarURL string `json:"author_avatar_url"`
 	CreatedAt       string `json:"created_at"` // ✅ ISO string, e.g. 2025-12-22T14:57:10Z
 	ReplyCount      int    `json:"reply_count"`
+	Status          string `json:"status"` // published | pending | rejected
 }
 
 type Reply struct {
@@ -46,30 +47,44 @@ type Reply struct {
 	AuthorName      string `json:"author_name"`
 	AuthorAvatarURL string `json:"author_avatar_url"`
 	CreatedAt       string `json:"created_at"` // ✅ ISO string
+	Status          string `json:"status"`
 }
 
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"name"` // frontend sends "name"
-	Email     string    `json:"email"`
-	AvatarURL string    `json:"avatar_url"`
-	Password  string    `json:"password"` // input only
-	CreatedAt time.Time `json:"created_at"`
+	ID         int       `json:"id"`
+	Username   string    `json:"name"` // frontend sends "name"
+	Email      string    `json:"email"`
+	AvatarURL  string    `json:"avatar_url"`
+	Password   string    `json:"password"` // input only
+	CreatedAt  time.Time `json:"created_at"`
+	TrustLevel int       `json:"trust_level"`
 }
 
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Cookie asks for an HttpOnly cookie session instead of a bearer token.
+	Cookie bool `json:"cookie"`
 }
 
 // ---------- Auth helpers ----------
 type ctxKey string
 
-const ctxUserID ctxKey = "userID"
+const (
+	ctxUserID    ctxKey = "userID"
+	ctxSessionID ctxKey = "sessionID"
+)
 
 type tokenPayload struct {
-	UserID int   `json:"uid"`
-	Exp    int64 `json:"exp"`
+	UserID    int    `json:"uid"`
+	SessionID string `json:"sid"`
+	Exp       int64  `json:"exp"`
+
+	// Scopes is set for personal access tokens only; nil means a full
+	// login session.
+	Scopes []string `json:"-"`
+	// ViaCookie is set when the token came from the session cookie.
+	ViaCookie bool `json:"-"`
 }
 
 func sign(data string) string {
@@ -78,10 +93,11 @@ func sign(data string) string {
 	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func makeToken(userID int) (string, error) {
+func makeToken(userID int, sessionID string) (string, error) {
 	pl := tokenPayload{
-		UserID: userID,
-		Exp:    time.Now().Add(24 * time.Hour).Unix(),
+		UserID:    userID,
+		SessionID: sessionID,
+		Exp:       time.Now().Add(cfg.Tokens.SessionTTL).Unix(),
 	}
 	b, err := json.Marshal(pl)
 	if err != nil {
@@ -91,50 +107,102 @@ func makeToken(userID int) (string, error) {
 	return p + "." + sign(p), nil
 }
 
-func parseToken(tok string) (int, error) {
+func parseToken(tok string) (tokenPayload, error) {
+	var pl tokenPayload
 	parts := strings.Split(tok, ".")
 	if len(parts) != 2 {
-		return 0, fmt.Errorf("bad token")
+		return pl, fmt.Errorf("bad token")
 	}
 	p, sig := parts[0], parts[1]
 
 	if !hmac.Equal([]byte(sign(p)), []byte(sig)) {
-		return 0, fmt.Errorf("bad signature")
+		return pl, fmt.Errorf("bad signature")
 	}
 
 	pb, err := base64.RawURLEncoding.DecodeString(p)
 	if err != nil {
-		return 0, fmt.Errorf("bad payload")
+		return pl, fmt.Errorf("bad payload")
 	}
 
-	var pl tokenPayload
 	if err := json.Unmarshal(pb, &pl); err != nil {
-		return 0, fmt.Errorf("bad payload json")
+		return pl, fmt.Errorf("bad payload json")
 	}
 	if time.Now().Unix() > pl.Exp {
-		return 0, fmt.Errorf("expired")
+		return pl, fmt.Errorf("expired")
 	}
-	return pl.UserID, nil
+	return pl, nil
+}
+
+// authenticate validates the bearer token (or session cookie) and its
+// session row, or a personal access token.
+func authenticate(r *http.Request) (tokenPayload, error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	viaCookie := false
+	if !ok {
+		c, err := r.Cookie(sessionCookie)
+		if err != nil {
+			return tokenPayload{}, fmt.Errorf("no bearer token or session cookie")
+		}
+		tok, viaCookie = c.Value, true
+	}
+	if !viaCookie && strings.HasPrefix(tok, accessTokenPrefix) {
+		return authenticateAccessToken(tok, r)
+	}
+	pl, err := parseToken(tok)
+	if err != nil {
+		return pl, err
+	}
+	pl.ViaCookie = viaCookie
+	if pl.SessionID == "" || !sessionActive(r.Context(), pl.SessionID, pl.UserID) {
+		return pl, fmt.Errorf("session revoked")
+	}
+	return pl, nil
 }
 
 func requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		pl, err := authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
 			return
 		}
-		tok := strings.TrimPrefix(auth, "Bearer ")
-		uid, err := parseToken(tok)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		infoFor(r).userID = pl.UserID
+		if pl.ViaCookie && !csrfOK(r, pl.SessionID) {
+			writeError(w, http.StatusForbidden, "csrf_failed", "Missing or invalid CSRF token")
 			return
 		}
-		ctx := context.WithValue(r.Context(), ctxUserID, uid)
+		if pl.Scopes != nil {
+			if ok, need := tokenAllows(pl.Scopes, r); !ok {
+				if need == "" {
+					writeError(w, http.StatusForbidden, "session_required", "This endpoint requires a login session")
+				} else {
+					writeError(w, http.StatusForbidden, "insufficient_scope", "Access token lacks the "+need+" scope")
+				}
+				return
+			}
+		}
+		touchLastSeen(r.Context(), pl.UserID)
+		ctx := context.WithValue(r.Context(), ctxUserID, pl.UserID)
+		ctx = context.WithValue(ctx, ctxSessionID, pl.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// optionalUserID is for public endpoints that do a little extra for signed-in
+// callers. It returns 0 for anonymous requests or invalid tokens.
+func optionalUserID(r *http.Request) int {
+	pl, err := authenticate(r)
+	if err != nil {
+		return 0
+	}
+	return pl.UserID
+}
+
+func getSessionID(r *http.Request) string {
+	sid, _ := r.Context().Value(ctxSessionID).(string)
+	return sid
+}
+
 func getUserID(r *http.Request) int {
 	v := r.Context().Value(ctxUserID)
 	if v == nil {
@@ -145,35 +213,126 @@ func getUserID(r *http.Request) int {
 
 // ---------- main ----------
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found (using system env vars)")
+	envErr := godotenv.Load()
+
+	c, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(2)
 	}
+	cfg = c
 
-	connStr := os.Getenv("DATABASE_URL")
-	if connStr == "" {
-		log.Fatal("DATABASE_URL is not set")
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch {
+	case command == "help":
+		fmt.Print(cliUsage)
+		return
+	case command == "config":
+		os.Exit(runConfigCommand(args))
+	case command == "serve" && len(args) > 0, command != "serve" && !knownCommand(command):
+		fmt.Fprint(os.Stderr, cliUsage)
+		os.Exit(2)
 	}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("JWT_SECRET is not set")
+	if err := cfg.validate(command == "serve"); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(cfg.Log, os.Stderr))
+	if envErr != nil {
+		slog.Debug("no .env file found, using system env vars")
+	}
+	if err := openDatabase(cfg.Database.URL); err != nil {
+		fatal("database connection failed", err)
 	}
-	jwtSecret = []byte(secret)
 
-	var err error
-	db, err = sql.Open("postgres", connStr)
+	if command != "serve" {
+		os.Exit(runCommand(command, args))
+	}
+	serve()
+}
+
+// serve runs the HTTP API until it fails or is told to shut down.
+func serve() {
+	jwtSecret = []byte(cfg.JWTSecret)
+	flushTraces, err := setupTracing(context.Background(), cfg.Tracing)
 	if err != nil {
-		log.Fatal(err)
+		fatal("tracing setup failed", err)
+	}
+
+	if err := startupMigrations(context.Background()); err != nil {
+		fatal("schema migrations failed", err)
 	}
-	if err = db.Ping(); err != nil {
-		log.Fatal("DB connection failed:", err)
+	// /readyz expects the upload directory to exist rather than creating it
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		fatal("upload directory setup failed", err)
 	}
 
+	if m, err := newMailer(cfg.SMTP); err != nil {
+		fatal("mailer setup failed", err)
+	} else {
+		mailer = m
+	}
+	goLoop(func(ctx context.Context) { logins.sweepLoop(ctx, 10*time.Minute) })
+	goLoop(func(ctx context.Context) { sessionSweepLoop(ctx, time.Hour) })
+
+	if spamFilter, err = newSpamFilter(cfg.Spam); err != nil {
+		fatal("spam filter setup failed", err)
+	}
+	if dbDriver == driverPostgres {
+		goLoop(func(ctx context.Context) { trustLoop(ctx, time.Hour) })
+		goLoop(func(ctx context.Context) { exportSweepLoop(ctx, time.Hour) })
+		if err := reloadContentFilter(context.Background()); err != nil {
+			slog.Error("content filter load failed", "err", err)
+		}
+		goLoop(func(ctx context.Context) { contentFilterLoop(ctx, time.Minute) })
+	} else {
+		slog.Warn("SQLite backend: messages, moderation, profiles, account settings, 2FA, OIDC and access tokens are unavailable")
+	}
+	if corsConfig, err = newCORSPolicy(cfg.CORS); err != nil {
+		fatal("cors setup failed", err)
+	}
+	if len(cfg.CORS.Origins) == 0 {
+		slog.Warn("no CORS origins configured, cross-origin requests will be refused")
+	}
+	if oidcEnabled(cfg.OIDC) {
+		oidcProvider = newOIDCClient(cfg.OIDC)
+	}
+
+	registerDBMetrics(db)
+	servers := []*http.Server{newServer(":"+strconv.Itoa(cfg.Port), routes())}
+	if cfg.Metrics.Addr != "" {
+		servers = append(servers, newMetricsServer(cfg.Metrics.Addr))
+		slog.Info("metrics server running", "addr", cfg.Metrics.Addr)
+	}
+
+	slog.Info("API running", "url", fmt.Sprintf("http://localhost:%d", cfg.Port))
+	listenAndServe(servers...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("trace export failed", "err", err)
+	}
+}
+
+// routes builds the API handler: every endpoint plus the middleware chain,
+// behind the health probes.
+func routes() http.Handler {
 	mux := http.NewServeMux()
 
 	// Auth
 	mux.Handle("/register", http.HandlerFunc(signupHandler))
 	mux.Handle("/login", http.HandlerFunc(loginHandler))
+	mux.Handle("POST /login/2fa", postgresOnly(http.HandlerFunc(login2FAHandler)))
+	mux.Handle("POST /logout", requireAuth(http.HandlerFunc(logoutHandler)))
+	mux.Handle("GET /auth/oidc/login", postgresOnly(http.HandlerFunc(oidcLoginHandler)))
+	mux.Handle("GET /auth/oidc/callback", postgresOnly(http.HandlerFunc(oidcCallbackHandler)))
 
 	// Replies (GET public, POST auth)
 	mux.Handle("/replies", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -203,138 +362,85 @@ func main() {
 
 	mux.Handle("/search", http.HandlerFunc(searchHandler))
 
+	// Private messages
+	mux.Handle("/conversations", postgresOnly(requireAuth(http.HandlerFunc(conversationsHandler))))
+	mux.Handle("GET /conversations/unread-count", postgresOnly(requireAuth(http.HandlerFunc(unreadCountHandler))))
+	mux.Handle("GET /conversations/{id}", postgresOnly(requireAuth(http.HandlerFunc(conversationByIDHandler))))
+	mux.Handle("/conversations/{id}/messages", postgresOnly(requireAuth(http.HandlerFunc(conversationMessagesHandler))))
+	mux.Handle("POST /conversations/{id}/leave", postgresOnly(requireAuth(http.HandlerFunc(leaveConversationHandler))))
+	mux.Handle("/blocks", postgresOnly(requireAuth(http.HandlerFunc(blocksHandler))))
+	mux.Handle("DELETE /blocks/{id}", postgresOnly(requireAuth(http.HandlerFunc(unblockHandler))))
+
+	// Moderation
+	mux.Handle("GET /mod/queue", postgresOnly(requireRole(http.HandlerFunc(modQueueHandler), roleModerator, roleAdmin)))
+	mux.Handle("POST /mod/{kind}/{id}", postgresOnly(requireRole(http.HandlerFunc(modDecisionHandler), roleModerator, roleAdmin)))
+	mux.Handle("/flags", postgresOnly(requireAuth(http.HandlerFunc(flagHandler))))
+
+	// Admin
+	mux.Handle("PUT /admin/users/{id}/trust-level", postgresOnly(requireRole(http.HandlerFunc(adminTrustLevelHandler), roleAdmin)))
+	mux.Handle("/admin/content-filters", postgresOnly(requireRole(http.HandlerFunc(contentFiltersHandler), roleAdmin)))
+	mux.Handle("/admin/content-filters/{id}", postgresOnly(requireRole(http.HandlerFunc(contentFilterByIDHandler), roleAdmin)))
+	mux.Handle("/admin/security-policy", postgresOnly(requireRole(http.HandlerFunc(securityPolicyHandler), roleAdmin)))
+
 	// uploads + avatar
-	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
+	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(cfg.UploadDir))))
 	mux.Handle("/me/avatar", requireAuth(http.HandlerFunc(uploadAvatarHandler)))
 
-	mux.HandleFunc("/debug-origin", func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		allowed := os.Getenv("FRONTEND_ORIGIN")
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"origin_raw":      origin,
-			"origin_trimmed":  strings.TrimRight(origin, "/"),
-			"allowed_raw":     allowed,
-			"allowed_trimmed": strings.TrimRight(allowed, "/"),
-			"method":          r.Method,
-		})
-	})
-
-	handler := cors(mux)
-
-	log.Println("🚀 API running at http://localhost:5000")
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5000"
+	// Profiles
+	mux.Handle("GET /users/{ref}", postgresOnly(http.HandlerFunc(userProfileHandler)))
+	mux.Handle("GET /users/{ref}/topics", postgresOnly(http.HandlerFunc(userTopicsHandler)))
+	mux.Handle("GET /users/{ref}/replies", postgresOnly(http.HandlerFunc(userRepliesHandler)))
+	mux.Handle("PATCH /me", postgresOnly(requireAuth(http.HandlerFunc(updateMeHandler))))
+
+	// Account settings
+	mux.Handle("PUT /me/password", postgresOnly(requireAuth(http.HandlerFunc(changePasswordHandler))))
+	mux.Handle("PUT /me/email", postgresOnly(requireAuth(http.HandlerFunc(changeEmailHandler))))
+	mux.Handle("GET /email/confirm", postgresOnly(http.HandlerFunc(confirmEmailHandler)))
+	mux.Handle("PUT /me/username", postgresOnly(requireAuth(http.HandlerFunc(changeUsernameHandler))))
+
+	// Data export & account deletion
+	mux.Handle("POST /me/export", postgresOnly(requireAuth(http.HandlerFunc(requestExportHandler))))
+	mux.Handle("GET /me/export/{id}", postgresOnly(requireAuth(http.HandlerFunc(exportStatusHandler))))
+	mux.Handle("GET /me/export/{id}/download", postgresOnly(requireAuth(http.HandlerFunc(exportDownloadHandler))))
+	mux.Handle("DELETE /me", postgresOnly(requireAuth(http.HandlerFunc(deleteMeHandler))))
+
+	// Two-factor authentication
+	mux.Handle("GET /me/2fa", postgresOnly(requireAuth(http.HandlerFunc(twoFactorStatusHandler))))
+	mux.Handle("POST /me/2fa/setup", postgresOnly(requireAuth(http.HandlerFunc(twoFactorSetupHandler))))
+	mux.Handle("POST /me/2fa/enable", postgresOnly(requireAuth(http.HandlerFunc(twoFactorEnableHandler))))
+	mux.Handle("POST /me/2fa/recovery-codes", postgresOnly(requireAuth(http.HandlerFunc(recoveryCodesHandler))))
+	mux.Handle("DELETE /me/2fa", postgresOnly(requireAuth(http.HandlerFunc(twoFactorDisableHandler))))
+
+	// Personal access tokens
+	mux.Handle("/me/tokens", postgresOnly(requireAuth(http.HandlerFunc(accessTokensHandler))))
+	mux.Handle("DELETE /me/tokens/{id}", postgresOnly(requireAuth(http.HandlerFunc(revokeAccessTokenHandler))))
+
+	if cfg.Metrics.Token != "" {
+		mux.Handle("GET /metrics", requireMetricsToken(metricsHandler()))
 	}
-	log.Fatal(http.ListenAndServe(":"+port, handler))
-}
 
-// ---------- CORS ----------
-func cors(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := strings.TrimRight(r.Header.Get("Origin"), "/")
-
-		allowed1 := strings.TrimRight(os.Getenv("FRONTEND_ORIGIN"), "/")
-		allowed2 := strings.TrimRight(os.Getenv("FRONTEND_ORIGIN_2"), "/")
-
-		// ✅ Decide if origin is allowed
-		isAllowed := false
-		if origin != "" {
-			if (allowed1 != "" && origin == allowed1) || (allowed2 != "" && origin == allowed2) {
-				isAllowed = true
-			}
-
-			// OPTIONAL: fail-open during testing if you forgot env vars
-			// if allowed1 == "" && allowed2 == "" {
-			// 	isAllowed = true
-			// }
-		}
+	mux.Handle("GET /debug-origin", requireRole(http.HandlerFunc(debugOriginHandler), roleAdmin))
 
-		// ✅ Always set CORS headers when allowed (including OPTIONS responses)
-		if origin != "" && isAllowed {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Vary", "Origin")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.Header().Set("Access-Control-Max-Age", "86400")
-		}
-
-		// ✅ Preflight
-		if r.Method == http.MethodOptions {
-			if origin != "" && !isAllowed {
-				http.Error(w, "CORS blocked for origin: "+origin, http.StatusForbidden)
-				return
-			}
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		// ✅ Block normal requests if origin is present but not allowed
-		if origin != "" && !isAllowed {
-			http.Error(w, "CORS blocked for origin: "+origin, http.StatusForbidden)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
+	return withProbes(withRequestInfo(traced(withRequestID(accessLog(securityHeaders(cors(limitRequests(muxErrors(mux)))))))))
 }
 
-
-
 // ---------- /topics ----------
 func topicsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	switch r.Method {
 	case http.MethodGet:
-		rows, err := db.Query(`
-			SELECT
-				t.id,
-				t.title,
-				t.content,
-				t.user_id,
-				u.username,
-				COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
-				COUNT(r.id) AS reply_count
-			FROM topics t
-			JOIN users u ON u.id = t.user_id
-			LEFT JOIN replies r ON r.topic_id = t.id
-			GROUP BY
-				t.id, t.title, t.content, t.user_id, u.username, u.avatar_url, t.created_at
-			ORDER BY t.created_at DESC
-		`)
+		topics, err := store.ListTopics(ctx)
 		if err != nil {
-			log.Println("TOPICS GET ERROR:", err)
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		defer rows.Close()
-
-		var topics []Topic
-		for rows.Next() {
-			var t Topic
-			if err := rows.Scan(
-				&t.ID,
-				&t.Title,
-				&t.Content,
-				&t.UserID,
-				&t.AuthorName,
-				&t.AuthorAvatarURL,
-				&t.CreatedAt,
-				&t.ReplyCount,
-			); err != nil {
-				log.Println("TOPICS SCAN ERROR:", err)
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			topics = append(topics, t)
+			serverError(w, "TOPICS GET", err)
+			return
 		}
 		_ = json.NewEncoder(w).Encode(topics)
 
 	case http.MethodPost:
 		uid := getUserID(r)
 		if uid == 0 {
-			http.Error(w, "Unauthorized", 401)
+			writeError(w, 401, "unauthorized", "Unauthorized")
 			return
 		}
 
@@ -342,99 +448,88 @@ func topicsHandler(w http.ResponseWriter, r *http.Request) {
 			Title   string `json:"title"`
 			Content string `json:"content"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid JSON", 400)
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		invalid := required(nil, "title", payload.Title)
+		invalid = required(invalid, "content", payload.Content)
+		if len(invalid) > 0 {
+			invalidFields(w, invalid...)
+			return
+		}
+		title, content, hold, ok := filterPost(w, payload.Title, payload.Content)
+		if !ok {
 			return
 		}
-		if strings.TrimSpace(payload.Title) == "" || strings.TrimSpace(payload.Content) == "" {
-			http.Error(w, "title and content required", 400)
+		payload.Title, payload.Content = title, content
+		if !requireCapability(w, r, capCreateTopics) {
+			return
+		}
+		if containsLink(payload.Title+" "+payload.Content) && !requireCapability(w, r, capPostLinks) {
 			return
 		}
 
-		var topicID int
-		if err := db.QueryRow(`
-			INSERT INTO topics (title, content, user_id, created_at)
-			VALUES ($1, $2, $3, NOW())
-			RETURNING id
-		`, payload.Title, payload.Content, uid).Scan(&topicID); err != nil {
-			http.Error(w, err.Error(), 500)
+		status, err := checkSpam(r, "topic", uid, payload.Title, payload.Content)
+		if err != nil {
+			serverError(w, "SPAM CHECK", err)
 			return
 		}
+		if hold {
+			status = "pending"
+		}
 
 		// Return fully formatted record (with avatar_url + ISO created_at)
-		var t Topic
-		if err := db.QueryRow(`
-			SELECT
-				t.id,
-				t.title,
-				t.content,
-				t.user_id,
-				u.username,
-				COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
-				0 AS reply_count
-			FROM topics t
-			JOIN users u ON u.id = t.user_id
-			WHERE t.id=$1
-		`, topicID).Scan(
-			&t.ID,
-			&t.Title,
-			&t.Content,
-			&t.UserID,
-			&t.AuthorName,
-			&t.AuthorAvatarURL,
-			&t.CreatedAt,
-			&t.ReplyCount,
-		); err != nil {
-			http.Error(w, err.Error(), 500)
+		t, err := store.CreateTopic(ctx, uid, payload.Title, payload.Content, status)
+		if err != nil {
+			serverError(w, "TOPICS", err)
 			return
 		}
+		topicsCreated.Inc()
 
+		if t.Status == "pending" {
+			// held for moderation: created, but not visible yet
+			w.WriteHeader(http.StatusAccepted)
+		}
 		_ = json.NewEncoder(w).Encode(t)
 
 	default:
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 	}
 }
 
 // ---------- /topics/{id} ----------
 func topicByIDHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/topics/"), "/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", 400)
+		writeError(w, 400, "invalid_id", "Invalid ID")
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		var t Topic
 		// include avatar_url + ISO created_at
-		row := db.QueryRow(`
-			SELECT
-				t.id, t.title, t.content, t.user_id,
-				u.username, COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
-				(SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id) AS reply_count
-			FROM topics t
-			JOIN users u ON u.id = t.user_id
-			WHERE t.id=$1
-		`, id)
-
-		if err := row.Scan(
-			&t.ID, &t.Title, &t.Content, &t.UserID,
-			&t.AuthorName, &t.AuthorAvatarURL,
-			&t.CreatedAt, &t.ReplyCount,
-		); err != nil {
-			http.Error(w, "Topic not found", 404)
+		t, err := store.Topic(ctx, id, true)
+		if err == ErrNotFound {
+			writeError(w, 404, "topic_not_found", "Topic not found")
+			return
+		}
+		if err != nil {
+			serverError(w, "TOPIC BY ID", err)
 			return
 		}
+		if uid := optionalUserID(r); uid != 0 {
+			markTopicRead(ctx, uid, id)
+		}
 		_ = json.NewEncoder(w).Encode(t)
 
 	case http.MethodPut:
 		uid := getUserID(r)
 		if uid == 0 {
-			http.Error(w, "Unauthorized", 401)
+			writeError(w, 401, "unauthorized", "Unauthorized")
 			return
 		}
 
@@ -442,121 +537,96 @@ func topicByIDHandler(w http.ResponseWriter, r *http.Request) {
 			Title   string `json:"title"`
 			Content string `json:"content"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid JSON", 400)
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
 			return
 		}
 
-		var ownerID int
-		if err := db.QueryRow(`SELECT user_id FROM topics WHERE id=$1`, id).Scan(&ownerID); err != nil {
-			http.Error(w, "Topic not found", 404)
+		ownerID, err := store.TopicOwner(ctx, id)
+		if err != nil {
+			writeError(w, 404, "topic_not_found", "Topic not found")
 			return
 		}
 		if uid != ownerID {
-			http.Error(w, "Forbidden", 403)
+			writeError(w, 403, "forbidden", "Forbidden")
+			return
+		}
+
+		title, content, hold, ok := filterPost(w, payload.Title, payload.Content)
+		if !ok {
+			return
+		}
+		payload.Title, payload.Content = title, content
+		if containsLink(payload.Title+" "+payload.Content) && !requireCapability(w, r, capPostLinks) {
 			return
 		}
 
-		if _, err := db.Exec(`UPDATE topics SET title=$1, content=$2 WHERE id=$3`, payload.Title, payload.Content, id); err != nil {
-			http.Error(w, err.Error(), 500)
+		status, err := checkSpam(r, "topic", uid, payload.Title, payload.Content)
+		if err != nil {
+			serverError(w, "SPAM CHECK", err)
 			return
 		}
+		if hold {
+			status = "pending"
+		}
 
-		// return updated record
-		var t Topic
-		if err := db.QueryRow(`
-			SELECT
-				t.id, t.title, t.content, t.user_id,
-				u.username, COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
-				(SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id) AS reply_count
-			FROM topics t
-			JOIN users u ON u.id = t.user_id
-			WHERE t.id=$1
-		`, id).Scan(
-			&t.ID, &t.Title, &t.Content, &t.UserID,
-			&t.AuthorName, &t.AuthorAvatarURL,
-			&t.CreatedAt, &t.ReplyCount,
-		); err != nil {
-			http.Error(w, err.Error(), 500)
+		// returns the updated record
+		t, err := store.UpdateTopic(ctx, id, payload.Title, payload.Content, status)
+		if err != nil {
+			serverError(w, "TOPIC BY ID", err)
 			return
 		}
 
+		if t.Status == "pending" {
+			w.WriteHeader(http.StatusAccepted)
+		}
 		_ = json.NewEncoder(w).Encode(t)
 
 	case http.MethodDelete:
 		uid := getUserID(r)
 		if uid == 0 {
-			http.Error(w, "Unauthorized", 401)
+			writeError(w, 401, "unauthorized", "Unauthorized")
 			return
 		}
 
-		var ownerID int
-		if err := db.QueryRow(`SELECT user_id FROM topics WHERE id=$1`, id).Scan(&ownerID); err != nil {
-			http.Error(w, "Topic not found", 404)
+		ownerID, err := store.TopicOwner(ctx, id)
+		if err != nil {
+			writeError(w, 404, "topic_not_found", "Topic not found")
 			return
 		}
 		if uid != ownerID {
-			http.Error(w, "Forbidden", 403)
+			writeError(w, 403, "forbidden", "Forbidden")
 			return
 		}
 
-		_, _ = db.Exec(`DELETE FROM topics WHERE id=$1`, id)
+		if err := store.DeleteTopic(ctx, id); err != nil {
+			serverError(w, "TOPIC BY ID", err)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 	}
 }
 
 // ---------- /replies ----------
 func repliesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	switch r.Method {
 	case http.MethodGet:
 		topicIDStr := r.URL.Query().Get("topic_id")
 		topicID, err := strconv.Atoi(topicIDStr)
 		if err != nil {
-			http.Error(w, "Invalid topic_id", 400)
-			return
-		}
-
-		rows, err := db.Query(`
-			SELECT
-				r.id,
-				r.topic_id,
-				r.content,
-				r.user_id,
-				u.username,
-				COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(r.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at
-			FROM replies r
-			JOIN users u ON u.id = r.user_id
-			WHERE r.topic_id=$1
-			ORDER BY r.created_at ASC
-		`, topicID)
+			writeError(w, 400, "invalid_topic_id", "Invalid topic_id")
+			return
+		}
+
+		replies, err := store.ListReplies(ctx, topicID)
 		if err != nil {
-			log.Println("REPLIES GET ERROR:", err)
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		defer rows.Close()
-
-		var replies []Reply
-		for rows.Next() {
-			var rp Reply
-			if err := rows.Scan(
-				&rp.ID,
-				&rp.TopicID,
-				&rp.Content,
-				&rp.UserID,
-				&rp.AuthorName,
-				&rp.AuthorAvatarURL,
-				&rp.CreatedAt,
-			); err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			replies = append(replies, rp)
+			serverError(w, "REPLIES GET", err)
+			return
 		}
 
 		_ = json.NewEncoder(w).Encode(replies)
@@ -564,7 +634,7 @@ func repliesHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		uid := getUserID(r)
 		if uid == 0 {
-			http.Error(w, "Unauthorized", 401)
+			writeError(w, 401, "unauthorized", "Unauthorized")
 			return
 		}
 
@@ -572,71 +642,74 @@ func repliesHandler(w http.ResponseWriter, r *http.Request) {
 			TopicID int    `json:"topic_id"`
 			Content string `json:"content"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid JSON", 400)
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		var invalid []FieldError
+		if payload.TopicID == 0 {
+			invalid = append(invalid, FieldError{"topic_id", "required", "is required"})
+		}
+		invalid = required(invalid, "content", payload.Content)
+		if len(invalid) > 0 {
+			invalidFields(w, invalid...)
 			return
 		}
-		if payload.TopicID == 0 || strings.TrimSpace(payload.Content) == "" {
-			http.Error(w, "topic_id and content required", 400)
+
+		_, content, hold, ok := filterPost(w, "", payload.Content)
+		if !ok {
+			return
+		}
+		payload.Content = content
+		if containsLink(payload.Content) && !requireCapability(w, r, capPostLinks) {
 			return
 		}
 
-		var replyID int
-		if err := db.QueryRow(`
-			INSERT INTO replies (topic_id, content, user_id, created_at)
-			VALUES ($1, $2, $3, NOW())
-			RETURNING id
-		`, payload.TopicID, payload.Content, uid).Scan(&replyID); err != nil {
-			http.Error(w, err.Error(), 500)
+		status, err := checkSpam(r, "reply", uid, "", payload.Content)
+		if err != nil {
+			serverError(w, "SPAM CHECK", err)
 			return
 		}
+		if hold {
+			status = "pending"
+		}
 
 		// Return fully formatted record (with avatar_url + ISO created_at)
-		var rp Reply
-		if err := db.QueryRow(`
-			SELECT
-				r.id,
-				r.topic_id,
-				r.content,
-				r.user_id,
-				u.username,
-				COALESCE(u.avatar_url, '') AS avatar_url,
-				to_char(r.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at
-			FROM replies r
-			JOIN users u ON u.id = r.user_id
-			WHERE r.id=$1
-		`, replyID).Scan(
-			&rp.ID,
-			&rp.TopicID,
-			&rp.Content,
-			&rp.UserID,
-			&rp.AuthorName,
-			&rp.AuthorAvatarURL,
-			&rp.CreatedAt,
-		); err != nil {
-			http.Error(w, err.Error(), 500)
+		rp, err := store.CreateReply(ctx, uid, payload.TopicID, payload.Content, status)
+		if err == ErrNotFound {
+			writeError(w, 404, "topic_not_found", "Topic not found")
+			return
+		}
+		if err != nil {
+			serverError(w, "REPLIES", err)
 			return
 		}
+		repliesCreated.Inc()
 
+		if rp.Status == "pending" {
+			w.WriteHeader(http.StatusAccepted)
+		}
 		_ = json.NewEncoder(w).Encode(rp)
 
 	default:
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 	}
 }
 
 // ---------- /replies/{id} ----------
 func replyByIDHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/replies/"), "/")
 	replyID, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", 400)
+		writeError(w, 400, "invalid_id", "Invalid ID")
 		return
 	}
 
 	uid := getUserID(r)
 	if uid == 0 {
-		http.Error(w, "Unauthorized", 401)
+		writeError(w, 401, "unauthorized", "Unauthorized")
 		return
 	}
 
@@ -645,100 +718,138 @@ func replyByIDHandler(w http.ResponseWriter, r *http.Request) {
 		var payload struct {
 			Content string `json:"content"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid JSON", 400)
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
 			return
 		}
 		if strings.TrimSpace(payload.Content) == "" {
-			http.Error(w, "content required", 400)
+			invalidFields(w, FieldError{"content", "required", "is required"})
 			return
 		}
 
-		var ownerID int
-		if err := db.QueryRow(`SELECT user_id FROM replies WHERE id=$1`, replyID).Scan(&ownerID); err != nil {
-			http.Error(w, "Reply not found", 404)
+		ownerID, err := store.ReplyOwner(ctx, replyID)
+		if err != nil {
+			writeError(w, 404, "reply_not_found", "Reply not found")
 			return
 		}
 		if uid != ownerID {
-			http.Error(w, "Forbidden", 403)
+			writeError(w, 403, "forbidden", "Forbidden")
 			return
 		}
 
-		if _, err := db.Exec(`UPDATE replies SET content=$1 WHERE id=$2`, payload.Content, replyID); err != nil {
-			http.Error(w, err.Error(), 500)
+		_, content, hold, ok := filterPost(w, "", payload.Content)
+		if !ok {
+			return
+		}
+		payload.Content = content
+		if containsLink(payload.Content) && !requireCapability(w, r, capPostLinks) {
 			return
 		}
 
+		status, err := checkSpam(r, "reply", uid, "", payload.Content)
+		if err != nil {
+			serverError(w, "SPAM CHECK", err)
+			return
+		}
+		if hold {
+			status = "pending"
+		}
+
+		status, err = store.UpdateReply(ctx, replyID, payload.Content, status)
+		if err != nil {
+			serverError(w, "REPLY BY ID", err)
+			return
+		}
+
+		if status == "pending" {
+			w.WriteHeader(http.StatusAccepted)
+		}
 		_ = json.NewEncoder(w).Encode(map[string]any{
 			"id":      replyID,
 			"content": payload.Content,
+			"status":  status,
 		})
 
 	case http.MethodDelete:
-		var ownerID int
-		if err := db.QueryRow(`SELECT user_id FROM replies WHERE id=$1`, replyID).Scan(&ownerID); err != nil {
-			http.Error(w, "Reply not found", 404)
+		ownerID, err := store.ReplyOwner(ctx, replyID)
+		if err != nil {
+			writeError(w, 404, "reply_not_found", "Reply not found")
 			return
 		}
 		if uid != ownerID {
-			http.Error(w, "Forbidden", 403)
+			writeError(w, 403, "forbidden", "Forbidden")
 			return
 		}
 
-		if _, err := db.Exec(`DELETE FROM replies WHERE id=$1`, replyID); err != nil {
-			http.Error(w, err.Error(), 500)
+		if err := store.DeleteReply(ctx, replyID); err != nil {
+			serverError(w, "REPLY BY ID", err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 	}
 }
 
 // ---------- /register ----------
 func signupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 		return
 	}
 
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid JSON", 400)
+	if err := decodeJSON(r, &user); err != nil {
+		badJSON(w, err)
 		return
 	}
 
-	if user.Username == "" || user.Email == "" || user.Password == "" {
-		http.Error(w, "All fields are required", 400)
+	user.Email = normalizeEmail(user.Email)
+	invalid := required(nil, "name", user.Username)
+	invalid = required(invalid, "email", user.Email)
+	invalid = required(invalid, "password", user.Password)
+	if len(invalid) > 0 {
+		invalidFields(w, invalid...)
+		return
+	}
+
+	if numericUsername(user.Username) {
+		invalidFields(w, FieldError{"name", "invalid_format", "can't be only digits"})
+		return
+	}
+
+	if reserved, err := usernameReserved(ctx, user.Username, 0); err != nil {
+		serverError(w, "REGISTER DB", err)
+		return
+	} else if reserved {
+		writeError(w, http.StatusConflict, "username_taken", "Username already exists")
+		return
+	}
+	if emailReserved(user.Email) {
+		writeError(w, http.StatusConflict, "email_taken", "Email already exists")
 		return
 	}
 
 	hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Failed to hash password", 500)
+		serverError(w, "SIGNUP", err)
 		return
 	}
 
-	err = db.QueryRow(
-		`INSERT INTO users (username, email, password_hash)
-		 VALUES ($1, $2, $3)
-		 RETURNING id, created_at`,
-		user.Username, user.Email, string(hashed),
-	).Scan(&user.ID, &user.CreatedAt)
-	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			if pqErr.Constraint == "users_username_key" {
-				http.Error(w, "Username already exists", http.StatusConflict)
-				return
-			}
-			if pqErr.Constraint == "users_email_key" {
-				http.Error(w, "Email already exists", http.StatusConflict)
-				return
-			}
-		}
-		log.Println("REGISTER DB ERROR:", err)
-		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+	switch err := store.CreateUser(ctx, &user, string(hashed)); err {
+	case nil:
+		registrations.WithLabelValues("password").Inc()
+	case ErrUsernameTaken:
+		writeError(w, http.StatusConflict, "username_taken", "Username already exists")
+		return
+	case ErrEmailTaken:
+		writeError(w, http.StatusConflict, "email_taken", "Email already exists")
+		return
+	default:
+		serverError(w, "REGISTER DB", err)
 		return
 	}
 
@@ -748,47 +859,104 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 
 // ---------- /login ----------
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 		return
 	}
 
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", 400)
+	if err := decodeJSON(r, &req); err != nil {
+		badJSON(w, err)
 		return
 	}
 	if req.Email == "" || req.Password == "" {
-		http.Error(w, "Email and password required", 400)
+		writeError(w, 400, "missing_credentials", "Email and password required")
 		return
 	}
 
-	var user User
-	var hash string
-	err := db.QueryRow(
-		`SELECT id, username, email, COALESCE(avatar_url, ''), password_hash, created_at
-		 FROM users WHERE email=$1`,
-		req.Email,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.AvatarURL, &hash, &user.CreatedAt)
+	email := normalizeEmail(req.Email)
+	ip := clientIP(r)
+	wait, lockedNow := logins.reserve(email, ip)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed login attempts, try again later")
+		return
+	}
 
-	if err == sql.ErrNoRows {
-		http.Error(w, "Invalid email or password", 401)
+	user, hash, err := store.UserByEmail(ctx, email)
+	found := err == nil
+	if err != nil && err != ErrNotFound {
+		logins.refund(email, ip)
+		serverError(w, "LOGIN", err)
 		return
 	}
-	if err != nil {
-		log.Println("LOGIN ERROR:", err)
-		http.Error(w, "Internal server error", 500)
+	if !found {
+		// burn the same bcrypt time as a real compare so unknown emails
+		// can't be told apart by response latency
+		hash = string(dummyHash)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil || !found {
+		loginFailures.WithLabelValues("password").Inc()
+		if lockedNow && found {
+			notifyLockout(ctx, user.Email, ip)
+		}
+		writeError(w, 401, "invalid_credentials", "Invalid email or password")
 		return
 	}
+	logins.succeed(email, ip)
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid email or password", 401)
+	// with 2FA on, the password only earns a challenge for /login/2fa
+	enabled, err := totpEnabled(ctx, user.ID)
+	if err != nil {
+		serverError(w, "LOGIN", err)
 		return
 	}
+	if enabled {
+		challenge, err := makeChallenge(user.ID)
+		if err != nil {
+			serverError(w, "LOGIN", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"two_factor_required": true,
+			"challenge":           challenge,
+		})
+		return
+	}
+
+	completeLogin(w, r, user, req.Cookie)
+}
+
+// completeLogin starts a session for an authenticated user and writes the
+// login response: a bearer token, or in cookie mode the session cookie plus
+// the CSRF token.
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, cookie bool) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+	refreshTrustLevel(ctx, user.ID)
+	if level, _, err := store.UserAccess(ctx, user.ID); err == nil {
+		user.TrustLevel = level
+	}
 
-	token, err := makeToken(user.ID)
+	token, err := createSession(user.ID, r)
 	if err != nil {
-		http.Error(w, "Internal server error", 500)
+		serverError(w, "LOGIN SESSION", err)
+		return
+	}
+
+	if cookie {
+		csrf, err := setSessionCookies(w, token)
+		if err != nil {
+			serverError(w, "LOGIN SESSION", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"user":       user,
+			"csrf_token": csrf,
+		})
 		return
 	}
 
@@ -799,89 +967,63 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
 	q := strings.TrimSpace(r.URL.Query().Get("q"))
 	if q == "" {
 		_ = json.NewEncoder(w).Encode([]Topic{})
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT
-			t.id, t.title, t.content, t.user_id,
-			u.username,
-			COALESCE(u.avatar_url, '') AS avatar_url,
-			to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at
-		FROM topics t
-		JOIN users u ON u.id = t.user_id
-		WHERE
-			t.title ILIKE '%' || $1 || '%' OR
-			t.content ILIKE '%' || $1 || '%' OR
-			u.username ILIKE '%' || $1 || '%'
-		ORDER BY t.created_at DESC
-	`, q)
+	results, err := store.SearchTopics(ctx, q)
 	if err != nil {
-		log.Println("SEARCH ERROR:", err)
-		http.Error(w, "Search failed", 500)
+		serverError(w, "SEARCH", err)
 		return
 	}
-	defer rows.Close()
-
-	var results []Topic
-	for rows.Next() {
-		var t Topic
-		if err := rows.Scan(
-			&t.ID,
-			&t.Title,
-			&t.Content,
-			&t.UserID,
-			&t.AuthorName,
-			&t.AuthorAvatarURL,
-			&t.CreatedAt,
-		); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		results = append(results, t)
-	}
 
 	_ = json.NewEncoder(w).Encode(results)
 }
 
 // ---------- /me/avatar ----------
 func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", 405)
+		methodNotAllowed(w)
 		return
 	}
 
 	uid := getUserID(r)
 	if uid == 0 {
-		http.Error(w, "Unauthorized", 401)
+		writeError(w, 401, "unauthorized", "Unauthorized")
+		return
+	}
+
+	if !requireCapability(w, r, capUploadImages) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 5<<20)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxUploadBytes)
 
-	if err := r.ParseMultipartForm(5 << 20); err != nil {
-		http.Error(w, "File too large / invalid form", 400)
+	if err := r.ParseMultipartForm(cfg.Limits.MaxUploadBytes); err != nil {
+		writeError(w, 400, "invalid_upload", "File too large / invalid form")
 		return
 	}
 
 	file, header, err := r.FormFile("avatar")
 	if err != nil {
-		http.Error(w, "Missing file field: avatar", 400)
+		writeError(w, 400, "missing_file", "Missing file field: avatar")
 		return
 	}
 	defer file.Close()
 
 	ct := header.Header.Get("Content-Type")
 	if !strings.HasPrefix(ct, "image/") {
-		http.Error(w, "Only image uploads are allowed", 400)
+		writeError(w, 400, "invalid_file_type", "Only image uploads are allowed")
 		return
 	}
 
-	if err := os.MkdirAll("./uploads", 0755); err != nil {
-		http.Error(w, "Failed to create uploads dir", 500)
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		serverError(w, "UPLOAD AVATAR", err)
 		return
 	}
 
@@ -891,24 +1033,25 @@ func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filename := fmt.Sprintf("u%d_%d%s", uid, time.Now().UnixNano(), ext)
-	dstPath := filepath.Join("./uploads", filename)
+	dstPath := filepath.Join(cfg.UploadDir, filename)
 
 	dst, err := os.Create(dstPath)
 	if err != nil {
-		http.Error(w, "Failed to save file", 500)
+		serverError(w, "UPLOAD AVATAR", err)
 		return
 	}
 	defer dst.Close()
 
 	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to write file", 500)
+		serverError(w, "UPLOAD AVATAR", err)
 		return
 	}
+	uploadsStored.Inc()
 
 	avatarURL := "/uploads/" + filename
 
-	if _, err := db.Exec(`UPDATE users SET avatar_url=$1 WHERE id=$2`, avatarURL, uid); err != nil {
-		http.Error(w, "Failed to update avatar_url", 500)
+	if err := store.SetAvatarURL(ctx, uid, avatarURL); err != nil {
+		serverError(w, "UPLOAD AVATAR", err)
 		return
 	}
 
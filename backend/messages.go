@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Private messages ----------
+
+type Message struct {
+	ID              int    `json:"id"`
+	ConversationID  int    `json:"conversation_id"`
+	UserID          int    `json:"user_id"`
+	AuthorName      string `json:"author_name"`
+	AuthorAvatarURL string `json:"author_avatar_url"`
+	Content         string `json:"content"`
+	CreatedAt       string `json:"created_at"`
+}
+
+type Participant struct {
+	UserID            int    `json:"user_id"`
+	Name              string `json:"name"`
+	AvatarURL         string `json:"avatar_url"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+	Left              bool   `json:"left"`
+}
+
+type Conversation struct {
+	ID            int           `json:"id"`
+	Subject       string        `json:"subject"`
+	CreatedAt     string        `json:"created_at"`
+	LastMessageAt string        `json:"last_message_at"`
+	UnreadCount   int           `json:"unread_count"`
+	LastMessage   *Message      `json:"last_message,omitempty"`
+	Participants  []Participant `json:"participants"`
+}
+
+const maxMessageLength = 10000
+
+// pageParams reads ?limit= and ?offset=, clamping limit to [1, max].
+func pageParams(r *http.Request, def, max int) (limit, offset int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = def
+	}
+	if limit > max {
+		limit = max
+	}
+	offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// isBlockedBy reports whether any of others has blocked uid.
+func isBlockedBy(ctx context.Context, uid int, others []int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var blocked bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks WHERE blocked_user_id=$1 AND user_id = ANY($2)
+		)
+	`, uid, pq.Array(others)).Scan(&blocked)
+	return blocked, err
+}
+
+// activeParticipant returns sql.ErrNoRows unless uid is in the conversation
+// and hasn't left it.
+func activeParticipant(ctx context.Context, convID, uid int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var one int
+	return db.QueryRowContext(ctx, `
+		SELECT 1 FROM conversation_participants
+		WHERE conversation_id=$1 AND user_id=$2 AND left_at IS NULL
+	`, convID, uid).Scan(&one)
+}
+
+func loadParticipants(ctx context.Context, convIDs []int) (map[int][]Participant, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.conversation_id, p.user_id, u.username, COALESCE(u.avatar_url, ''),
+			p.last_read_message_id, p.left_at IS NOT NULL
+		FROM conversation_participants p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.conversation_id = ANY($1)
+		ORDER BY p.joined_at, p.user_id
+	`, pq.Array(convIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int][]Participant{}
+	for rows.Next() {
+		var convID int
+		var p Participant
+		if err := rows.Scan(&convID, &p.UserID, &p.Name, &p.AvatarURL, &p.LastReadMessageID, &p.Left); err != nil {
+			return nil, err
+		}
+		out[convID] = append(out[convID], p)
+	}
+	return out, rows.Err()
+}
+
+// insertMessage stores a message and moves the sender's read marker past it.
+func insertMessage(ctx context.Context, tx *sql.Tx, convID, uid int, content string) (int, error) {
+	var msgID int
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO messages (conversation_id, user_id, content) VALUES ($1, $2, $3)
+		RETURNING id
+	`, convID, uid, content).Scan(&msgID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE conversations SET last_message_at=NOW() WHERE id=$1`, convID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE conversation_participants SET last_read_message_id=$1
+		WHERE conversation_id=$2 AND user_id=$3
+	`, msgID, convID, uid); err != nil {
+		return 0, err
+	}
+	return msgID, nil
+}
+
+func loadMessage(ctx context.Context, id int) (Message, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var m Message
+	err := db.QueryRowContext(ctx, `
+		SELECT m.id, m.conversation_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content,
+			to_char(m.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		FROM messages m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.id=$1
+	`, id).Scan(&m.ID, &m.ConversationID, &m.UserID, &m.AuthorName, &m.AuthorAvatarURL, &m.Content, &m.CreatedAt)
+	return m, err
+}
+
+// ---------- /conversations ----------
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		limit, offset := pageParams(r, 20, 100)
+		rows, err := db.QueryContext(ctx, `
+			SELECT
+				c.id, c.subject,
+				to_char(c.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+				to_char(c.last_message_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+				(SELECT COUNT(*) FROM messages m
+				 WHERE m.conversation_id = c.id AND m.id > p.last_read_message_id AND m.user_id <> $1),
+				lm.id, lm.user_id, lm.username, lm.avatar_url, lm.content, lm.created_at
+			FROM conversations c
+			JOIN conversation_participants p ON p.conversation_id = c.id
+			LEFT JOIN LATERAL (
+				SELECT m.id, m.user_id, u.username, COALESCE(u.avatar_url, '') AS avatar_url, m.content,
+					to_char(m.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at
+				FROM messages m
+				JOIN users u ON u.id = m.user_id
+				WHERE m.conversation_id = c.id
+				ORDER BY m.id DESC
+				LIMIT 1
+			) lm ON true
+			WHERE p.user_id = $1 AND p.left_at IS NULL
+			ORDER BY c.last_message_at DESC, c.id DESC
+			LIMIT $2 OFFSET $3
+		`, uid, limit, offset)
+		if err != nil {
+			serverError(w, "INBOX", err)
+			return
+		}
+		defer rows.Close()
+
+		convs := []Conversation{}
+		var ids []int
+		for rows.Next() {
+			var c Conversation
+			var lastID, lastUser sql.NullInt64
+			var lastName, lastAvatar, lastContent, lastAt sql.NullString
+			if err := rows.Scan(&c.ID, &c.Subject, &c.CreatedAt, &c.LastMessageAt, &c.UnreadCount,
+				&lastID, &lastUser, &lastName, &lastAvatar, &lastContent, &lastAt); err != nil {
+				serverError(w, "INBOX SCAN", err)
+				return
+			}
+			if lastID.Valid {
+				c.LastMessage = &Message{
+					ID:              int(lastID.Int64),
+					ConversationID:  c.ID,
+					UserID:          int(lastUser.Int64),
+					AuthorName:      lastName.String,
+					AuthorAvatarURL: lastAvatar.String,
+					Content:         lastContent.String,
+					CreatedAt:       lastAt.String,
+				}
+			}
+			convs = append(convs, c)
+			ids = append(ids, c.ID)
+		}
+		if err := rows.Err(); err != nil {
+			serverError(w, "INBOX SCAN", err)
+			return
+		}
+
+		parts, err := loadParticipants(ctx, ids)
+		if err != nil {
+			serverError(w, "INBOX PARTICIPANTS", err)
+			return
+		}
+		for i := range convs {
+			convs[i].Participants = parts[convs[i].ID]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(convs)
+
+	case http.MethodPost:
+		var payload struct {
+			RecipientIDs []int  `json:"recipient_ids"`
+			Subject      string `json:"subject"`
+			Content      string `json:"content"`
+		}
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		payload.Content = strings.TrimSpace(payload.Content)
+		if payload.Content == "" {
+			invalidFields(w, FieldError{"content", "required", "is required"})
+			return
+		}
+		if utf8.RuneCountInString(payload.Content) > maxMessageLength {
+			invalidFields(w, FieldError{"content", "too_long", "must be at most " + strconv.Itoa(maxMessageLength) + " characters"})
+			return
+		}
+
+		seen := map[int]bool{uid: true}
+		var recipients []int
+		for _, id := range payload.RecipientIDs {
+			if !seen[id] {
+				seen[id] = true
+				recipients = append(recipients, id)
+			}
+		}
+		if len(recipients) == 0 {
+			invalidFields(w, FieldError{"recipient_ids", "required", "at least one recipient is required"})
+			return
+		}
+
+		var found int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE id = ANY($1)`, pq.Array(recipients)).Scan(&found); err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		if found != len(recipients) {
+			writeError(w, 404, "recipient_not_found", "Recipient not found")
+			return
+		}
+		blocked, err := isBlockedBy(ctx, uid, recipients)
+		if err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		if blocked {
+			writeError(w, http.StatusForbidden, "recipient_blocked", "A recipient is not accepting messages from you")
+			return
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		defer tx.Rollback()
+
+		var convID int
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO conversations (subject, created_by) VALUES ($1, $2) RETURNING id
+		`, strings.TrimSpace(payload.Subject), uid).Scan(&convID); err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO conversation_participants (conversation_id, user_id)
+			SELECT $1, unnest($2::int[])
+		`, convID, pq.Array(append([]int{uid}, recipients...))); err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		msgID, err := insertMessage(ctx, tx, convID, uid, payload.Content)
+		if err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			serverError(w, "CONVERSATION CREATE", err)
+			return
+		}
+
+		conv, err := loadConversation(ctx, convID)
+		if err != nil {
+			serverError(w, "CONVERSATION LOAD", err)
+			return
+		}
+		if m, err := loadMessage(ctx, msgID); err == nil {
+			conv.LastMessage = &m
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(conv)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func loadConversation(ctx context.Context, id int) (Conversation, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var c Conversation
+	if err := db.QueryRowContext(ctx, `
+		SELECT id, subject,
+			to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_message_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		FROM conversations WHERE id=$1
+	`, id).Scan(&c.ID, &c.Subject, &c.CreatedAt, &c.LastMessageAt); err != nil {
+		return c, err
+	}
+	parts, err := loadParticipants(ctx, []int{id})
+	if err != nil {
+		return c, err
+	}
+	c.Participants = parts[id]
+	return c, nil
+}
+
+// ---------- /conversations/unread-count ----------
+func unreadCountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	var unread int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM conversation_participants p
+		JOIN messages m ON m.conversation_id = p.conversation_id
+		WHERE p.user_id = $1 AND p.left_at IS NULL
+			AND m.id > p.last_read_message_id AND m.user_id <> $1
+	`, getUserID(r)).Scan(&unread); err != nil {
+		serverError(w, "UNREAD COUNT", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"unread": unread})
+}
+
+// ---------- /conversations/{id} ----------
+//
+// Participants carry last_read_message_id, which doubles as read receipts.
+func conversationByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+	ctx := r.Context()
+	if err := activeParticipant(ctx, id, getUserID(r)); err != nil {
+		writeError(w, 404, "conversation_not_found", "Conversation not found")
+		return
+	}
+
+	conv, err := loadConversation(ctx, id)
+	if err != nil {
+		serverError(w, "CONVERSATION LOAD", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(conv)
+}
+
+// ---------- /conversations/{id}/messages ----------
+//
+// GET pages backwards from the newest message: pass ?before=<oldest id seen>
+// to fetch older ones. Fetching marks the returned messages as read.
+func conversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+	convID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+	if err := activeParticipant(ctx, convID, uid); err != nil {
+		writeError(w, 404, "conversation_not_found", "Conversation not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limit, _ := pageParams(r, 50, 200)
+		before, err := strconv.Atoi(r.URL.Query().Get("before"))
+		if err != nil || before <= 0 {
+			before = int(^uint32(0) >> 1)
+		}
+
+		rows, err := db.QueryContext(ctx, `
+			SELECT m.id, m.conversation_id, m.user_id, u.username, COALESCE(u.avatar_url, ''), m.content,
+				to_char(m.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+			FROM messages m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.conversation_id=$1 AND m.id < $2
+			ORDER BY m.id DESC
+			LIMIT $3
+		`, convID, before, limit)
+		if err != nil {
+			serverError(w, "MESSAGES GET", err)
+			return
+		}
+		defer rows.Close()
+
+		msgs := []Message{}
+		for rows.Next() {
+			var m Message
+			if err := rows.Scan(&m.ID, &m.ConversationID, &m.UserID, &m.AuthorName, &m.AuthorAvatarURL, &m.Content, &m.CreatedAt); err != nil {
+				serverError(w, "MESSAGES SCAN", err)
+				return
+			}
+			msgs = append(msgs, m)
+		}
+		// oldest first, like replies
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+
+		if len(msgs) > 0 {
+			if _, err := db.ExecContext(ctx, `
+				UPDATE conversation_participants SET last_read_message_id=$1
+				WHERE conversation_id=$2 AND user_id=$3 AND last_read_message_id < $1
+			`, msgs[len(msgs)-1].ID, convID, uid); err != nil {
+				slog.ErrorContext(ctx, "read receipt update failed", "conversation_id", convID, "err", err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(msgs)
+
+	case http.MethodPost:
+		var payload struct {
+			Content string `json:"content"`
+		}
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		payload.Content = strings.TrimSpace(payload.Content)
+		if payload.Content == "" {
+			invalidFields(w, FieldError{"content", "required", "is required"})
+			return
+		}
+		if utf8.RuneCountInString(payload.Content) > maxMessageLength {
+			invalidFields(w, FieldError{"content", "too_long", "must be at most " + strconv.Itoa(maxMessageLength) + " characters"})
+			return
+		}
+
+		var others []int
+		rows, err := db.QueryContext(ctx, `
+			SELECT user_id FROM conversation_participants
+			WHERE conversation_id=$1 AND user_id<>$2 AND left_at IS NULL
+		`, convID, uid)
+		if err != nil {
+			serverError(w, "MESSAGE SEND", err)
+			return
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err == nil {
+				others = append(others, id)
+			}
+		}
+		rows.Close()
+
+		blocked, err := isBlockedBy(ctx, uid, others)
+		if err != nil {
+			serverError(w, "MESSAGE SEND", err)
+			return
+		}
+		if blocked {
+			writeError(w, http.StatusForbidden, "recipient_blocked", "A participant is not accepting messages from you")
+			return
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			serverError(w, "MESSAGE SEND", err)
+			return
+		}
+		defer tx.Rollback()
+		msgID, err := insertMessage(ctx, tx, convID, uid, payload.Content)
+		if err != nil {
+			serverError(w, "MESSAGE SEND", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			serverError(w, "MESSAGE SEND", err)
+			return
+		}
+
+		m, err := loadMessage(ctx, msgID)
+		if err != nil {
+			serverError(w, "MESSAGE LOAD", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(m)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// ---------- /conversations/{id}/leave ----------
+func leaveConversationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	convID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE conversation_participants SET left_at=NOW()
+		WHERE conversation_id=$1 AND user_id=$2 AND left_at IS NULL
+	`, convID, getUserID(r))
+	if err != nil {
+		serverError(w, "LEAVE CONVERSATION", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, "conversation_not_found", "Conversation not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------- /blocks ----------
+func blocksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.QueryContext(ctx, `
+			SELECT u.id, u.username, COALESCE(u.avatar_url, '')
+			FROM user_blocks b
+			JOIN users u ON u.id = b.blocked_user_id
+			WHERE b.user_id=$1
+			ORDER BY b.created_at DESC
+		`, uid)
+		if err != nil {
+			serverError(w, "BLOCKS GET", err)
+			return
+		}
+		defer rows.Close()
+
+		type blocked struct {
+			UserID    int    `json:"user_id"`
+			Name      string `json:"name"`
+			AvatarURL string `json:"avatar_url"`
+		}
+		list := []blocked{}
+		for rows.Next() {
+			var b blocked
+			if err := rows.Scan(&b.UserID, &b.Name, &b.AvatarURL); err != nil {
+				serverError(w, "BLOCKS SCAN", err)
+				return
+			}
+			list = append(list, b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		var payload struct {
+			UserID int `json:"user_id"`
+		}
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		if payload.UserID == 0 || payload.UserID == uid {
+			invalidFields(w, FieldError{"user_id", "invalid", "must be another user's id"})
+			return
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO user_blocks (user_id, blocked_user_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, uid, payload.UserID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+				writeError(w, 404, "user_not_found", "User not found")
+				return
+			}
+			serverError(w, "BLOCK", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// ---------- /blocks/{id} ----------
+func unblockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	blockedID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM user_blocks WHERE user_id=$1 AND blocked_user_id=$2`, getUserID(r), blockedID); err != nil {
+		serverError(w, "UNBLOCK", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ---------- Metrics ----------
+//
+// Prometheus metrics for HTTP traffic, the database pool, a few business
+// events and the Go runtime. They are exposed on a separate listener
+// (METRICS_ADDR, meant for a private network) and/or at /metrics on the API
+// behind a bearer token (METRICS_TOKEN). With neither set nothing is exposed.
+
+type MetricsConfig struct {
+	Addr  string `yaml:"addr" env:"METRICS_ADDR" flag:"metrics-addr" usage:"listen address of a separate metrics server, e.g. :9090"`
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+var metrics = prometheus.NewRegistry()
+
+var (
+	httpRequests = promauto.With(metrics).NewCounterVec(prometheus.CounterOpts{
+		Name: "forum_http_requests_total",
+		Help: "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.With(metrics).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "forum_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	registrations = promauto.With(metrics).NewCounterVec(prometheus.CounterOpts{
+		Name: "forum_registrations_total",
+		Help: "Accounts created, by sign-up method.",
+	}, []string{"method"})
+	loginsStarted = promauto.With(metrics).NewCounter(prometheus.CounterOpts{
+		Name: "forum_logins_total",
+		Help: "Successful logins (sessions started).",
+	})
+	loginFailures = promauto.With(metrics).NewCounterVec(prometheus.CounterOpts{
+		Name: "forum_login_failures_total",
+		Help: "Rejected login attempts, by step (password or 2fa).",
+	}, []string{"step"})
+	topicsCreated = promauto.With(metrics).NewCounter(prometheus.CounterOpts{
+		Name: "forum_topics_created_total",
+		Help: "Topics created, including ones held for moderation.",
+	})
+	repliesCreated = promauto.With(metrics).NewCounter(prometheus.CounterOpts{
+		Name: "forum_replies_created_total",
+		Help: "Replies created, including ones held for moderation.",
+	})
+	uploadsStored = promauto.With(metrics).NewCounter(prometheus.CounterOpts{
+		Name: "forum_uploads_total",
+		Help: "Files uploaded (avatars).",
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// registerDBMetrics adds the connection pool statistics of conn.
+func registerDBMetrics(conn *sql.DB) {
+	metrics.MustRegister(collectors.NewDBStatsCollector(conn, dbDriver))
+}
+
+// observeRequest records a finished request. Route is the mux pattern, so
+// the label set stays bounded no matter what paths clients ask for.
+func observeRequest(method, route string, status int, took time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER"
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(took.Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+// requireMetricsToken guards /metrics on the public API.
+func requireMetricsToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(tok), []byte(cfg.Metrics.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newMetricsServer serves only /metrics, for METRICS_ADDR.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler())
+	return newServer(addr, mux)
+}
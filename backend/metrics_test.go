@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	prev := cfg.Metrics
+	t.Cleanup(func() { cfg.Metrics = prev })
+	cfg.Metrics.Token = strings.Repeat("m", minSecretLen)
+
+	a := newTestAPI(t)
+	a.member("ada")
+	a.do("GET", "/no-such-endpoint", "", nil)
+
+	expectProblem(t, a.do("GET", "/metrics", "", nil), http.StatusUnauthorized, "unauthorized")
+	expectProblem(t, a.do("GET", "/metrics", "wrong", nil), http.StatusUnauthorized, "unauthorized")
+
+	rec := a.do("GET", "/metrics", cfg.Metrics.Token, nil)
+	expectStatus(t, rec, http.StatusOK)
+	body := rec.Body.String()
+	for _, want := range []string{
+		`forum_http_requests_total{method="POST",route="/register",status="200"}`,
+		`forum_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`forum_http_request_duration_seconds_bucket{method="POST",route="/login"`,
+		`forum_registrations_total{method="password"}`,
+		`forum_logins_total`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
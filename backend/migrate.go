@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// ---------- Schema migrations ----------
+//
+// migrations/NNNN_name.up.sql and .down.sql are embedded in the binary and
+// applied in version order, each in its own transaction. Applied versions
+// are recorded in schema_migrations; a Postgres advisory lock keeps two
+// instances starting at once from migrating concurrently. SQLite databases
+// have their own, smaller set under migrations/sqlite.
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is an arbitrary constant shared by every instance.
+const migrationLockID = 7_302_215_001
+
+var migrationNameRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func migrationDir() string {
+	if dbDriver == driverSQLite {
+		return "migrations/sqlite"
+	}
+	return "migrations"
+}
+
+func loadMigrations() ([]migration, error) {
+	dir := migrationDir()
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := migrationNameRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: bad file name", e.Name())
+		}
+		v, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(migrationFiles, dir+"/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[v]
+		if mig == nil {
+			mig = &migration{Version: v, Name: m[2]}
+			byVersion[v] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", v, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	list := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+const (
+	pgSchemaMigrations = `
+		CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			version    integer PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamp without time zone NOT NULL DEFAULT now()
+		)`
+	sqliteSchemaMigrations = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`
+)
+
+// withMigrationLock runs fn on a single connection holding the advisory lock,
+// after making sure schema_migrations exists. SQLite needs no lock: it is
+// only ever opened by one instance, through a single connection.
+func withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ddl := sqliteSchemaMigrations
+	if dbDriver == driverPostgres {
+		ddl = pgSchemaMigrations
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+				slog.Error("migration unlock failed", "err", err)
+			}
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, ddl); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	appliedAt := `to_char(applied_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')`
+	if dbDriver == driverSQLite {
+		appliedAt = `strftime('%Y-%m-%dT%H:%M:%SZ', applied_at)`
+	}
+	rows, err := conn.QueryContext(ctx, `
+		SELECT version, `+appliedAt+`
+		FROM schema_migrations
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]string{}
+	for rows.Next() {
+		var v int
+		var at string
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	body, record, args := m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, []any{m.Version, m.Name}
+	if !up {
+		body, record, args = m.Down, `DELETE FROM schema_migrations WHERE version=$1`, []any{m.Version}
+	}
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration and returns the ones it ran.
+func migrateUp(ctx context.Context) ([]migration, error) {
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var ran []migration
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range all {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			slog.Info("migrated up", "version", m.Version, "name", m.Name)
+			ran = append(ran, m)
+		}
+		return nil
+	})
+	return ran, err
+}
+
+// migrateDown rolls back the latest steps applied migrations.
+func migrateDown(ctx context.Context, steps int) ([]migration, error) {
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var ran []migration
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(all) - 1; i >= 0 && len(ran) < steps; i-- {
+			m := all[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			slog.Info("migrated down", "version", m.Version, "name", m.Name)
+			ran = append(ran, m)
+		}
+		return nil
+	})
+	return ran, err
+}
+
+type migrationState struct {
+	Version   int
+	Name      string
+	AppliedAt string // "" when pending
+}
+
+// migrationStatus lists known migrations, plus any applied versions this
+// binary doesn't know about (the database is newer than the code).
+func migrationStatus(ctx context.Context) ([]migrationState, error) {
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var states []migrationState
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		known := map[int]bool{}
+		for _, m := range all {
+			known[m.Version] = true
+			states = append(states, migrationState{m.Version, m.Name, applied[m.Version]})
+		}
+		for v, at := range applied {
+			if !known[v] {
+				states = append(states, migrationState{v, "(unknown to this build)", at})
+			}
+		}
+		return nil
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, err
+}
+
+// startupMigrations runs pending migrations when auto_migrate is set and
+// otherwise only warns about them.
+func startupMigrations(ctx context.Context) error {
+	if cfg.AutoMigrate {
+		_, err := migrateUp(ctx)
+		return err
+	}
+	states, err := migrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range states {
+		if s.AppliedAt == "" {
+			pending++
+		}
+	}
+	if pending > 0 {
+		slog.Warn("pending schema migrations; run `forum-backend migrate up` or set AUTO_MIGRATE=true", "pending", pending)
+	}
+	return nil
+}
+
+// ---------- forum-backend migrate ----------
+
+func runMigrateCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(cliErr, "usage: forum-backend migrate up | down [-steps N] | status")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		ran, err := migrateUp(ctx)
+		if err != nil {
+			fmt.Fprintln(cliErr, "migrate up:", err)
+			return 1
+		}
+		if len(ran) == 0 {
+			fmt.Fprintln(cliOut, "schema is up to date")
+		}
+
+	case "down":
+		fset := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		fset.SetOutput(cliErr)
+		steps := fset.Int("steps", 1, "number of migrations to roll back")
+		if err := fset.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *steps < 1 {
+			fmt.Fprintln(cliErr, "-steps must be at least 1")
+			return 2
+		}
+		ran, err := migrateDown(ctx, *steps)
+		if err != nil {
+			fmt.Fprintln(cliErr, "migrate down:", err)
+			return 1
+		}
+		if len(ran) == 0 {
+			fmt.Fprintln(cliOut, "nothing to roll back")
+		}
+
+	case "status":
+		states, err := migrationStatus(ctx)
+		if err != nil {
+			fmt.Fprintln(cliErr, "migrate status:", err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(cliOut, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range states {
+			at := s.AppliedAt
+			if at == "" {
+				at = "pending"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, at)
+		}
+		tw.Flush()
+
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.replies;
+DROP TABLE IF EXISTS public.topics;
+DROP TABLE IF EXISTS public.users;
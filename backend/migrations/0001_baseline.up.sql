@@ -0,0 +1,29 @@
+-- Users, topics and replies as they existed before versioned migrations,
+-- plus users.avatar_url which the old schema.sql dump was missing. Written
+-- with IF NOT EXISTS so it also adopts databases created from that dump.
+
+CREATE TABLE IF NOT EXISTS public.users (
+    id            serial PRIMARY KEY,
+    username      text NOT NULL CONSTRAINT users_username_key UNIQUE,
+    password_hash text NOT NULL,
+    created_at    timestamp without time zone DEFAULT now(),
+    email         text NOT NULL CONSTRAINT users_email_key UNIQUE
+);
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS avatar_url text;
+
+CREATE TABLE IF NOT EXISTS public.topics (
+    id         serial PRIMARY KEY,
+    title      text NOT NULL,
+    content    text NOT NULL,
+    created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP,
+    user_id    integer REFERENCES public.users(id)
+);
+
+CREATE TABLE IF NOT EXISTS public.replies (
+    id         serial PRIMARY KEY,
+    topic_id   integer REFERENCES public.topics(id) ON DELETE CASCADE,
+    content    text NOT NULL,
+    created_at timestamp without time zone DEFAULT now(),
+    user_id    integer NOT NULL REFERENCES public.users(id)
+);
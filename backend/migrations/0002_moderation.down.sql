@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS public.spam_classes;
+DROP TABLE IF EXISTS public.spam_tokens;
+
+DROP INDEX IF EXISTS public.replies_status_idx;
+DROP INDEX IF EXISTS public.topics_status_idx;
+
+ALTER TABLE public.replies DROP COLUMN IF EXISTS status;
+ALTER TABLE public.topics DROP COLUMN IF EXISTS status;
+ALTER TABLE public.users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,28 @@
+-- Roles, pending-approval state for posts and the spam classifier corpus.
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'moderator', 'admin'));
+
+ALTER TABLE public.topics
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published'
+    CHECK (status IN ('published', 'pending', 'rejected'));
+
+ALTER TABLE public.replies
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published'
+    CHECK (status IN ('published', 'pending', 'rejected'));
+
+CREATE INDEX IF NOT EXISTS topics_status_idx ON public.topics (status);
+CREATE INDEX IF NOT EXISTS replies_status_idx ON public.replies (status);
+
+-- naive Bayes counts, trained from moderator decisions
+CREATE TABLE IF NOT EXISTS public.spam_tokens (
+    token      text PRIMARY KEY,
+    spam_count integer NOT NULL DEFAULT 0,
+    ham_count  integer NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS public.spam_classes (
+    class text PRIMARY KEY CHECK (class IN ('spam', 'ham')),
+    docs  integer NOT NULL DEFAULT 0
+);
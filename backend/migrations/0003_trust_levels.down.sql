@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS public.flags;
+DROP TABLE IF EXISTS public.topic_reads;
+
+ALTER TABLE public.users DROP COLUMN IF EXISTS trust_level_locked;
+ALTER TABLE public.users DROP COLUMN IF EXISTS trust_level;
@@ -0,0 +1,31 @@
+-- Trust levels, read tracking and post flags.
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS trust_level smallint NOT NULL DEFAULT 0
+    CHECK (trust_level BETWEEN 0 AND 3);
+
+-- set by admins; the periodic job leaves locked levels alone
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS trust_level_locked boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS public.topic_reads (
+    user_id  integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    topic_id integer NOT NULL REFERENCES public.topics(id) ON DELETE CASCADE,
+    read_at  timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, topic_id)
+);
+
+CREATE TABLE IF NOT EXISTS public.flags (
+    id             serial PRIMARY KEY,
+    user_id        integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    target_kind    text NOT NULL CHECK (target_kind IN ('topic', 'reply')),
+    target_id      integer NOT NULL,
+    target_user_id integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    reason         text NOT NULL DEFAULT '',
+    weight         integer NOT NULL,
+    created_at     timestamp without time zone NOT NULL DEFAULT now(),
+    UNIQUE (user_id, target_kind, target_id)
+);
+
+CREATE INDEX IF NOT EXISTS flags_target_idx ON public.flags (target_kind, target_id);
+CREATE INDEX IF NOT EXISTS flags_target_user_idx ON public.flags (target_user_id);
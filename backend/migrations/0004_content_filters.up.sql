@@ -0,0 +1,11 @@
+-- Admin-managed word/regex rules applied to post titles and content.
+
+CREATE TABLE IF NOT EXISTS public.content_filters (
+    id          serial PRIMARY KEY,
+    pattern     text NOT NULL,
+    is_regex    boolean NOT NULL DEFAULT false,
+    action      text NOT NULL CHECK (action IN ('reject', 'mask', 'require_approval')),
+    replacement text NOT NULL DEFAULT '',
+    created_by  integer REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at  timestamp without time zone NOT NULL DEFAULT now()
+);
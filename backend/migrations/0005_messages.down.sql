@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.user_blocks;
+DROP TABLE IF EXISTS public.messages;
+DROP TABLE IF EXISTS public.conversation_participants;
+DROP TABLE IF EXISTS public.conversations;
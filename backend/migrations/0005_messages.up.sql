@@ -0,0 +1,40 @@
+-- Private conversations between users, plus per-user blocks.
+
+CREATE TABLE IF NOT EXISTS public.conversations (
+    id              serial PRIMARY KEY,
+    subject         text NOT NULL DEFAULT '',
+    created_by      integer REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    last_message_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS public.conversation_participants (
+    conversation_id      integer NOT NULL REFERENCES public.conversations(id) ON DELETE CASCADE,
+    user_id              integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    joined_at            timestamp without time zone NOT NULL DEFAULT now(),
+    left_at              timestamp without time zone,
+    -- read receipt: everything up to and including this message has been seen
+    last_read_message_id integer NOT NULL DEFAULT 0,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS conversation_participants_user_idx
+    ON public.conversation_participants (user_id) WHERE left_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS public.messages (
+    id              serial PRIMARY KEY,
+    conversation_id integer NOT NULL REFERENCES public.conversations(id) ON DELETE CASCADE,
+    user_id         integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    content         text NOT NULL,
+    created_at      timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_idx ON public.messages (conversation_id, id);
+
+CREATE TABLE IF NOT EXISTS public.user_blocks (
+    user_id         integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    blocked_user_id integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    created_at      timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, blocked_user_id),
+    CHECK (user_id <> blocked_user_id)
+);
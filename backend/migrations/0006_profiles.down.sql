@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS public.replies_user_idx;
+DROP INDEX IF EXISTS public.topics_user_idx;
+
+ALTER TABLE public.users DROP COLUMN IF EXISTS last_seen_at;
+ALTER TABLE public.users DROP COLUMN IF EXISTS location;
+ALTER TABLE public.users DROP COLUMN IF EXISTS website;
+ALTER TABLE public.users DROP COLUMN IF EXISTS bio;
+ALTER TABLE public.users DROP COLUMN IF EXISTS display_name;
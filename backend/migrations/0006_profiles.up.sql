@@ -0,0 +1,10 @@
+-- Public profile fields and last-seen tracking.
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '';
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS bio text NOT NULL DEFAULT '';
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS website text NOT NULL DEFAULT '';
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS location text NOT NULL DEFAULT '';
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS last_seen_at timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS topics_user_idx ON public.topics (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS replies_user_idx ON public.replies (user_id, created_at DESC);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.username_history;
+ALTER TABLE public.users DROP COLUMN IF EXISTS username_changed_at;
+DROP TABLE IF EXISTS public.email_changes;
+DROP TABLE IF EXISTS public.sessions;
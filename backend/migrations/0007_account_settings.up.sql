@@ -0,0 +1,31 @@
+-- Server-side sessions (so tokens can be revoked), pending email changes and
+-- username history for redirects.
+
+CREATE TABLE IF NOT EXISTS public.sessions (
+    id           text PRIMARY KEY,
+    user_id      integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    created_at   timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at   timestamp without time zone NOT NULL,
+    revoked_at   timestamp without time zone,
+    ip           text NOT NULL DEFAULT '',
+    user_agent   text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON public.sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS public.email_changes (
+    token_hash text PRIMARY KEY,
+    user_id    integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    new_email  text NOT NULL,
+    expires_at timestamp without time zone NOT NULL
+);
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS username_changed_at timestamp without time zone;
+
+CREATE TABLE IF NOT EXISTS public.username_history (
+    old_username text NOT NULL,
+    user_id      integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    changed_at   timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS username_history_old_idx ON public.username_history (lower(old_username));
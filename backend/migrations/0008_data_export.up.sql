@@ -0,0 +1,12 @@
+-- Asynchronous personal data exports.
+
+CREATE TABLE IF NOT EXISTS public.data_exports (
+    id          text PRIMARY KEY,
+    user_id     integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    status      text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    error       text NOT NULL DEFAULT '',
+    created_at  timestamp without time zone NOT NULL DEFAULT now(),
+    finished_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_idx ON public.data_exports (user_id);
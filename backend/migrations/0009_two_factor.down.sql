@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.site_settings;
+DROP TABLE IF EXISTS public.recovery_codes;
+DROP TABLE IF EXISTS public.user_totp;
@@ -0,0 +1,25 @@
+-- TOTP two-factor authentication, recovery codes and site-wide settings.
+
+CREATE TABLE IF NOT EXISTS public.user_totp (
+    user_id        integer PRIMARY KEY REFERENCES public.users(id) ON DELETE CASCADE,
+    secret         text NOT NULL,
+    -- NULL while enrolment hasn't been confirmed with a first code
+    confirmed_at   timestamp without time zone,
+    -- last accepted time step, so a code can't be replayed
+    last_used_step bigint NOT NULL DEFAULT 0,
+    created_at     timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS public.recovery_codes (
+    id        serial PRIMARY KEY,
+    user_id   integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    code_hash text NOT NULL,
+    used_at   timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON public.recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS public.site_settings (
+    key   text PRIMARY KEY,
+    value text NOT NULL
+);
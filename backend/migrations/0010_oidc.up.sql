@@ -0,0 +1,12 @@
+-- External identities from an OpenID Connect provider, linked to users.
+
+CREATE TABLE IF NOT EXISTS public.user_identities (
+    issuer     text NOT NULL,
+    subject    text NOT NULL,
+    user_id    integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    email      text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_idx ON public.user_identities (user_id);
@@ -0,0 +1,19 @@
+-- Personal access tokens for scripts and bots.
+
+CREATE TABLE IF NOT EXISTS public.access_tokens (
+    id           serial PRIMARY KEY,
+    user_id      integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    name         text NOT NULL,
+    -- sha256 of the token; the token itself is only shown once
+    token_hash   text NOT NULL UNIQUE,
+    -- first characters of the token so users can tell them apart
+    prefix       text NOT NULL,
+    scopes       text[] NOT NULL,
+    created_at   timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at   timestamp without time zone,
+    last_used_at timestamp without time zone,
+    last_used_ip text,
+    revoked_at   timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS access_tokens_user_idx ON public.access_tokens (user_id);
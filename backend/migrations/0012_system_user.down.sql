@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.users_system_idx;
+ALTER TABLE public.users DROP COLUMN IF EXISTS is_system;
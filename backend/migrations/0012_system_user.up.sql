@@ -0,0 +1,15 @@
+-- The placeholder account anonymized content is moved to. It is created here
+-- rather than on first use so nobody can register its name or email first.
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS is_system boolean NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_system_idx ON public.users (is_system) WHERE is_system;
+
+-- adopt a placeholder created by an earlier version
+UPDATE public.users SET is_system = true
+WHERE email = 'deleted-user@invalid' AND username = '[deleted]' AND password_hash = '!'
+  AND NOT EXISTS (SELECT 1 FROM public.users WHERE is_system);
+
+INSERT INTO public.users (username, email, password_hash, is_system)
+SELECT '[deleted]', 'deleted-user@invalid', '!', true
+WHERE NOT EXISTS (SELECT 1 FROM public.users WHERE is_system);
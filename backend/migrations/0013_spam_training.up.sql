@@ -0,0 +1,11 @@
+-- What each moderator decision taught the spam classifier, so a reversed
+-- decision can be taken back and a post never counts twice.
+
+CREATE TABLE IF NOT EXISTS public.spam_training (
+    kind    text NOT NULL CHECK (kind IN ('topics', 'replies')),
+    post_id integer NOT NULL,
+    spam    boolean NOT NULL,
+    -- tokens as trained; the post may have been edited or deleted since
+    tokens  text[] NOT NULL,
+    PRIMARY KEY (kind, post_id)
+);
@@ -0,0 +1,14 @@
+-- Emails are unique regardless of case, and logins match on lower(email).
+-- Earlier versions only enforced exact-case uniqueness, so accounts that
+-- duplicate an older one's address in another case get a placeholder
+-- address that keeps the original for reference.
+
+UPDATE public.users u
+SET email = u.id || '.' || replace(u.email, '@', '.at.') || '@duplicate.invalid'
+WHERE EXISTS (
+    SELECT 1 FROM public.users o
+    WHERE lower(o.email) = lower(u.email) AND o.id < u.id
+);
+
+DROP INDEX IF EXISTS public.users_email_lower_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON public.users (lower(email));
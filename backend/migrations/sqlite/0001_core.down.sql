@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS topic_reads;
+DROP TABLE IF EXISTS replies;
+DROP TABLE IF EXISTS topics;
+DROP TABLE IF EXISTS username_history;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,69 @@
+-- The tables behind the Store: users, topics, replies, read tracking,
+-- sessions and username history. Timestamps are UTC text in SQLite's
+-- CURRENT_TIMESTAMP format ("YYYY-MM-DD HH:MM:SS") so they compare
+-- correctly as strings.
+
+CREATE TABLE users (
+    id                  INTEGER PRIMARY KEY,
+    username            TEXT NOT NULL UNIQUE,
+    email               TEXT NOT NULL UNIQUE,
+    password_hash       TEXT NOT NULL,
+    avatar_url          TEXT,
+    role                TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+    trust_level         INTEGER NOT NULL DEFAULT 0 CHECK (trust_level BETWEEN 0 AND 3),
+    trust_level_locked  INTEGER NOT NULL DEFAULT 0,
+    last_seen_at        TEXT,
+    created_at          TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX users_email_lower_idx ON users (lower(email));
+
+CREATE TABLE username_history (
+    old_username TEXT NOT NULL,
+    user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    changed_at   TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX username_history_old_idx ON username_history (lower(old_username));
+
+CREATE TABLE topics (
+    id         INTEGER PRIMARY KEY,
+    title      TEXT NOT NULL,
+    content    TEXT NOT NULL,
+    user_id    INTEGER NOT NULL REFERENCES users(id),
+    status     TEXT NOT NULL DEFAULT 'published' CHECK (status IN ('published', 'pending', 'rejected')),
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX topics_status_created_idx ON topics (status, created_at);
+
+CREATE TABLE replies (
+    id         INTEGER PRIMARY KEY,
+    topic_id   INTEGER NOT NULL REFERENCES topics(id) ON DELETE CASCADE,
+    content    TEXT NOT NULL,
+    user_id    INTEGER NOT NULL REFERENCES users(id),
+    status     TEXT NOT NULL DEFAULT 'published' CHECK (status IN ('published', 'pending', 'rejected')),
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX replies_topic_idx ON replies (topic_id, created_at);
+CREATE INDEX replies_user_idx ON replies (user_id);
+
+CREATE TABLE topic_reads (
+    user_id  INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    topic_id INTEGER NOT NULL REFERENCES topics(id) ON DELETE CASCADE,
+    read_at  TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, topic_id)
+);
+
+CREATE TABLE sessions (
+    id         TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TEXT NOT NULL,
+    revoked_at TEXT,
+    ip         TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX sessions_user_idx ON sessions (user_id);
@@ -0,0 +1,23 @@
+-- Full-text index over topic titles and content. It's an external-content
+-- FTS5 table kept in step with topics by triggers.
+
+CREATE VIRTUAL TABLE topics_fts USING fts5(
+    title, content,
+    content='topics', content_rowid='id',
+    tokenize='unicode61 remove_diacritics 2'
+);
+
+INSERT INTO topics_fts (rowid, title, content) SELECT id, title, content FROM topics;
+
+CREATE TRIGGER topics_fts_insert AFTER INSERT ON topics BEGIN
+    INSERT INTO topics_fts (rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
+
+CREATE TRIGGER topics_fts_delete AFTER DELETE ON topics BEGIN
+    INSERT INTO topics_fts (topics_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+END;
+
+CREATE TRIGGER topics_fts_update AFTER UPDATE OF title, content ON topics BEGIN
+    INSERT INTO topics_fts (topics_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO topics_fts (rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
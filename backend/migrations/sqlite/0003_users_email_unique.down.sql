@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_email_lower_key;
+CREATE INDEX users_email_lower_idx ON users (lower(email));
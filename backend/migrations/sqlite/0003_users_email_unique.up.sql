@@ -0,0 +1,13 @@
+-- Emails are unique regardless of case. Accounts that duplicate an older
+-- one's address in another case get a placeholder address that keeps the
+-- original for reference.
+
+UPDATE users
+SET email = id || '.' || replace(email, '@', '.at.') || '@duplicate.invalid'
+WHERE EXISTS (
+    SELECT 1 FROM users o
+    WHERE lower(o.email) = lower(users.email) AND o.id < users.id
+);
+
+DROP INDEX IF EXISTS users_email_lower_idx;
+CREATE UNIQUE INDEX users_email_lower_key ON users (lower(email));
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// ---------- /mod/queue ----------
+func modQueueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	topics := []Topic{}
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			t.id, t.title, t.content, t.user_id,
+			u.username, COALESCE(u.avatar_url, '') AS avatar_url,
+			to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+			t.status
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.status='pending'
+		ORDER BY t.created_at ASC
+	`)
+	if err != nil {
+		serverError(w, "MOD QUEUE", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Topic
+		if err := rows.Scan(&t.ID, &t.Title, &t.Content, &t.UserID,
+			&t.AuthorName, &t.AuthorAvatarURL, &t.CreatedAt, &t.Status); err != nil {
+			serverError(w, "MOD QUEUE SCAN", err)
+			return
+		}
+		topics = append(topics, t)
+	}
+
+	replies := []Reply{}
+	rrows, err := db.QueryContext(ctx, `
+		SELECT
+			r.id, r.topic_id, r.content, r.user_id,
+			u.username, COALESCE(u.avatar_url, '') AS avatar_url,
+			to_char(r.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+			r.status
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.status='pending'
+		ORDER BY r.created_at ASC
+	`)
+	if err != nil {
+		serverError(w, "MOD QUEUE", err)
+		return
+	}
+	defer rrows.Close()
+	for rrows.Next() {
+		var rp Reply
+		if err := rrows.Scan(&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+			&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status); err != nil {
+			serverError(w, "MOD QUEUE SCAN", err)
+			return
+		}
+		replies = append(replies, rp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"topics":  topics,
+		"replies": replies,
+	})
+}
+
+// ---------- /mod/{kind}/{id} ----------
+//
+// Approving publishes the post, rejecting hides it. A decision that changes
+// the post's status is fed to the Bayes classifier, replacing whatever an
+// earlier decision on the same post taught it. Rejecting also works on
+// already published posts, which is how moderators report spam that slipped
+// through.
+func modDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	var query string
+	switch r.PathValue("kind") {
+	case "topics":
+		query = `UPDATE topics t SET status=$1 FROM topics old WHERE t.id=$2 AND old.id=t.id
+			RETURNING old.status, t.title || E'\n' || t.content`
+	case "replies":
+		query = `UPDATE replies r SET status=$1 FROM replies old WHERE r.id=$2 AND old.id=r.id
+			RETURNING old.status, r.content`
+	default:
+		writeError(w, 404, "not_found", "Not found")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+
+	var payload struct {
+		Action string `json:"action"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	var status string
+	switch payload.Action {
+	case "approve":
+		status = "published"
+	case "reject":
+		status = "rejected"
+	default:
+		invalidFields(w, FieldError{"action", "invalid_choice", `must be "approve" or "reject"`})
+		return
+	}
+
+	var prev, text string
+	if err := db.QueryRowContext(ctx, query, status, id).Scan(&prev, &text); err == sql.ErrNoRows {
+		writeError(w, 404, "post_not_found", "Post not found")
+		return
+	} else if err != nil {
+		serverError(w, "MOD DECISION", err)
+		return
+	}
+
+	// only a decision that changes the post teaches the classifier
+	if prev != status {
+		if err := bayes.train(ctx, r.PathValue("kind"), id, text, status == "rejected"); err != nil {
+			slog.ErrorContext(ctx, "spam model training failed", "err", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":     id,
+		"status": status,
+	})
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ---------- OpenID Connect sign-in ----------
+//
+// Authorization-code flow with PKCE. The provider is configured through
+// OIDC_ISSUER / OIDC_CLIENT_ID / OIDC_CLIENT_SECRET / OIDC_REDIRECT_URL and
+// found via discovery; ID tokens are verified against the provider's JWKS.
+// After the callback the user gets a normal forum session token.
+
+const (
+	oidcFlowCookie = "webby_oidc"
+	oidcFlowTTL    = 10 * time.Minute
+	oidcCacheTTL   = time.Hour
+	oidcClockSkew  = time.Minute
+)
+
+type oidcConfig struct {
+	Issuer       string `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID     string `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes       string `yaml:"scopes" env:"OIDC_SCOPES"`
+	// where the browser is sent after login; the token goes in the fragment
+	PostLoginURL string `yaml:"post_login_url" env:"OIDC_POST_LOGIN_URL"`
+}
+
+// oidcProvider is nil when OIDC isn't configured.
+var oidcProvider *oidcClient
+
+// oidcEnabled reports whether c names a provider; validation makes sure the
+// required fields come together.
+func oidcEnabled(c oidcConfig) bool {
+	return c.Issuer != "" && c.ClientID != "" && c.RedirectURL != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcClient struct {
+	cfg  oidcConfig
+	http *http.Client
+
+	mu        sync.Mutex
+	disc      *oidcDiscovery
+	discAt    time.Time
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+	keysRetry time.Time
+}
+
+func newOIDCClient(cfg oidcConfig) *oidcClient {
+	cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+	return &oidcClient{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second, Transport: tracedTransport()}}
+}
+
+func (c *oidcClient) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (c *oidcClient) discovery(ctx context.Context) (*oidcDiscovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disc != nil && time.Since(c.discAt) < oidcCacheTTL {
+		return c.disc, nil
+	}
+
+	var d oidcDiscovery
+	if err := c.getJSON(ctx, c.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, c.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document")
+	}
+	c.disc, c.discAt = &d, time.Now()
+	return c.disc, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key for kid. An unknown kid triggers one JWKS
+// refetch (at most once a minute) to pick up key rotation.
+func (c *oidcClient) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	k, ok := c.keys[kid]
+	fresh := time.Since(c.keysAt) < oidcCacheTTL
+	canRetry := time.Now().After(c.keysRetry)
+	c.mu.Unlock()
+	if ok && fresh {
+		return k, nil
+	}
+	if ok && !canRetry {
+		return k, nil
+	}
+	if !ok && !canRetry {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	d, err := c.discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		pk, err := j.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[j.Kid] = pk
+	}
+
+	c.mu.Lock()
+	c.keys, c.keysAt, c.keysRetry = keys, time.Now(), time.Now().Add(time.Minute)
+	c.mu.Unlock()
+
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     any             `json:"email_verified"` // some providers send "true"
+	PreferredUsername string          `json:"preferred_username"`
+	Name              string          `json:"name"`
+}
+
+func (cl idTokenClaims) emailVerified() bool {
+	switch v := cl.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func (cl idTokenClaims) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(cl.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(cl.Audience, &many) == nil {
+		for _, a := range many {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks signature, issuer, audience, expiry and nonce.
+func (c *oidcClient) verifyIDToken(ctx context.Context, raw, nonce string) (idTokenClaims, error) {
+	var claims idTokenClaims
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed id_token")
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("bad id_token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return claims, fmt.Errorf("bad id_token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("bad id_token signature")
+	}
+
+	pub, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pk, ok := pub.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pk, crypto.SHA256, digest[:], sig) != nil {
+			return claims, fmt.Errorf("id_token signature invalid")
+		}
+	case "ES256":
+		pk, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 ||
+			!ecdsa.Verify(pk, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return claims, fmt.Errorf("id_token signature invalid")
+		}
+	default:
+		// never accept "none" or HMAC algorithms from a provider
+		return claims, fmt.Errorf("unsupported id_token alg %q", header.Alg)
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("bad id_token payload")
+	}
+	if err := json.Unmarshal(pb, &claims); err != nil {
+		return claims, fmt.Errorf("bad id_token payload")
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != c.cfg.Issuer:
+		return claims, fmt.Errorf("id_token issuer mismatch")
+	case !claims.hasAudience(c.cfg.ClientID):
+		return claims, fmt.Errorf("id_token audience mismatch")
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)):
+		return claims, fmt.Errorf("id_token expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return claims, fmt.Errorf("id_token issued in the future")
+	case claims.Nonce != nonce:
+		return claims, fmt.Errorf("id_token nonce mismatch")
+	case claims.Subject == "":
+		return claims, fmt.Errorf("id_token without subject")
+	}
+	return claims, nil
+}
+
+// exchange trades the authorization code for tokens and returns the id_token.
+func (c *oidcClient) exchange(ctx context.Context, code, verifier string) (string, error) {
+	d, err := c.discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.cfg.RedirectURL},
+		"client_id":     {c.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, tok.Error, tok.Desc)
+	}
+	if tok.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// ---------- flow state ----------
+//
+// state, nonce and the PKCE verifier travel in a signed, short-lived cookie
+// so the server keeps no per-login state.
+
+type oidcFlow struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Cookie   bool   `json:"c,omitempty"` // finish with a cookie session
+	Exp      int64  `json:"exp"`
+}
+
+func encodeFlow(f oidcFlow) string {
+	b, _ := json.Marshal(f)
+	p := base64.RawURLEncoding.EncodeToString(b)
+	return p + "." + sign("oidc:"+p)
+}
+
+func decodeFlow(v string) (oidcFlow, error) {
+	var f oidcFlow
+	p, sig, ok := strings.Cut(v, ".")
+	if !ok || !hmac.Equal([]byte(sign("oidc:"+p)), []byte(sig)) {
+		return f, fmt.Errorf("bad flow cookie")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil || json.Unmarshal(b, &f) != nil {
+		return f, fmt.Errorf("bad flow cookie")
+	}
+	if time.Now().Unix() > f.Exp {
+		return f, fmt.Errorf("login took too long")
+	}
+	return f, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ---------- GET /auth/oidc/login ----------
+//
+// ?cookie=1 finishes with an HttpOnly cookie session instead of a token.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		writeError(w, 404, "oidc_not_configured", "OIDC sign-in is not configured")
+		return
+	}
+	d, err := oidcProvider.discovery(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc discovery failed", "err", err)
+		writeError(w, http.StatusBadGateway, "oidc_unavailable", "Identity provider unavailable")
+		return
+	}
+
+	flow := oidcFlow{
+		State:    randomToken(16),
+		Nonce:    randomToken(16),
+		Verifier: randomToken(32),
+		Cookie:   r.URL.Query().Get("cookie") == "1",
+		Exp:      time.Now().Add(oidcFlowTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    encodeFlow(flow),
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(oidcProvider.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode, // must survive the top-level redirect back
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcProvider.cfg.ClientID},
+		"redirect_uri":          {oidcProvider.cfg.RedirectURL},
+		"scope":                 {oidcProvider.cfg.Scopes},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {pkceChallenge(flow.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// ---------- GET /auth/oidc/callback ----------
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		writeError(w, 404, "oidc_not_configured", "OIDC sign-in is not configured")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		writeError(w, 400, "oidc_failed", "Sign-in was cancelled or failed: "+e)
+		return
+	}
+
+	c, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		writeError(w, 400, "oidc_state_missing", "Sign-in session missing, start again")
+		return
+	}
+	flow, err := decodeFlow(c.Value)
+	if err != nil || r.URL.Query().Get("state") != flow.State {
+		writeError(w, 400, "oidc_state_invalid", "Sign-in session invalid, start again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: "/auth/oidc", MaxAge: -1})
+
+	rawID, err := oidcProvider.exchange(r.Context(), r.URL.Query().Get("code"), flow.Verifier)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc code exchange failed", "err", err)
+		writeError(w, http.StatusBadGateway, "oidc_exchange_failed", "Could not complete sign-in")
+		return
+	}
+	claims, err := oidcProvider.verifyIDToken(r.Context(), rawID, flow.Nonce)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc id token rejected", "err", err)
+		writeError(w, 401, "oidc_invalid_token", "Could not verify identity")
+		return
+	}
+
+	uid, err := userForIdentity(r.Context(), oidcProvider.cfg.Issuer, claims)
+	if errors.Is(err, errEmailTaken) {
+		writeError(w, http.StatusConflict, "email_taken", "An account with this email already exists and the identity provider has not verified the address, so it can't be linked; sign in with your password instead")
+		return
+	}
+	if err != nil {
+		serverError(w, "OIDC LINK", err)
+		return
+	}
+
+	// forum 2FA still applies to accounts that enabled it
+	enabled, err := totpEnabled(r.Context(), uid)
+	if err != nil {
+		serverError(w, "OIDC LOGIN", err)
+		return
+	}
+	result := url.Values{}
+	if enabled {
+		challenge, err := makeChallenge(uid)
+		if err != nil {
+			serverError(w, "OIDC CALLBACK", err)
+			return
+		}
+		result.Set("challenge", challenge)
+	} else {
+		token, err := createSession(uid, r)
+		if err != nil {
+			serverError(w, "OIDC SESSION", err)
+			return
+		}
+		refreshTrustLevel(r.Context(), uid)
+		if flow.Cookie {
+			csrf, err := setSessionCookies(w, token)
+			if err != nil {
+				serverError(w, "OIDC SESSION", err)
+				return
+			}
+			result.Set("csrf_token", csrf)
+		} else {
+			result.Set("token", token)
+		}
+	}
+
+	if oidcProvider.cfg.PostLoginURL != "" {
+		// fragment, so the token never reaches server logs or Referer headers
+		http.Redirect(w, r, oidcProvider.cfg.PostLoginURL+"#"+result.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	out := map[string]any{}
+	for k := range result {
+		out[k] = result.Get(k)
+	}
+	if enabled {
+		out["two_factor_required"] = true
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// ---------- account linking ----------
+
+var errEmailTaken = errors.New("email belongs to an unlinked account")
+
+var usernameStrip = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// baseUsername derives a valid username candidate from the ID token.
+func baseUsername(cl idTokenClaims) string {
+	for _, cand := range []string{cl.PreferredUsername, cl.Name, strings.Split(cl.Email, "@")[0]} {
+		s := usernameStrip.ReplaceAllString(strings.ReplaceAll(cand, " ", "_"), "")
+		if len(s) > 24 {
+			s = s[:24]
+		}
+		if len(s) >= 3 && !numericUsername(s) {
+			return s
+		}
+	}
+	return "user"
+}
+
+// userForIdentity returns the user linked to (issuer, sub). Unknown identities
+// are linked to an existing account only if the provider vouches for the
+// email; otherwise a new account is created, with a numeric suffix appended
+// until the username is free.
+func userForIdentity(ctx context.Context, issuer string, cl idTokenClaims) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var uid int
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM user_identities WHERE issuer=$1 AND subject=$2`, issuer, cl.Subject).Scan(&uid)
+	if err == nil {
+		return uid, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	email := normalizeEmail(cl.Email)
+	if email != "" && !emailReserved(email) {
+		err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE lower(email)=$1 AND NOT is_system`, email).Scan(&uid)
+		switch {
+		case err == nil && cl.emailVerified():
+			_, err = db.ExecContext(ctx, `INSERT INTO user_identities (issuer, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+				issuer, cl.Subject, uid, email)
+			return uid, err
+		case err == nil:
+			return 0, errEmailTaken
+		case err != sql.ErrNoRows:
+			return 0, err
+		}
+	}
+	if email == "" || emailReserved(email) || !cl.emailVerified() {
+		// users.email is required; use an address that can never receive mail,
+		// so an unverified claim can't squat on an address someone else owns
+		host := issuer
+		if u, err := url.Parse(issuer); err == nil && u.Host != "" {
+			host = u.Hostname()
+		}
+		email = cl.Subject + "@" + host + ".invalid"
+	}
+
+	base := baseUsername(cl)
+	for i := 1; i <= 50; i++ {
+		name := base
+		if i > 1 {
+			name = base + "-" + strconv.Itoa(i)
+		}
+		if reserved, err := usernameReserved(ctx, name, 0); err != nil {
+			return 0, err
+		} else if reserved {
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		err = tx.QueryRowContext(ctx, `INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id`,
+			name, email, noPassword).Scan(&uid)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "users_username_key" {
+			tx.Rollback()
+			continue
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO user_identities (issuer, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+				issuer, cl.Subject, uid, cl.Email)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		registrations.WithLabelValues("oidc").Inc()
+		return uid, nil
+	}
+	return 0, fmt.Errorf("no free username for %q", base)
+}
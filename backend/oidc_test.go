@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is an identity provider serving discovery, JWKS and a token
+// endpoint. Codes are handed out by authorize, as if the user had signed in
+// at the provider, and only redeemed with the matching PKCE verifier.
+type testIdP struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]idpGrant
+}
+
+type idpGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+const testClientID = "forum"
+
+// newTestIdP starts the provider and points the forum's OIDC settings at it
+// for the rest of the test.
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testIdP{t: t, key: key, codes: map[string]idpGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.srv.URL,
+			AuthorizationEndpoint: p.srv.URL + "/authorize",
+			TokenEndpoint:         p.srv.URL + "/token",
+			JWKSURI:               p.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{{
+			Kty: "RSA", Kid: "k1", Use: "sig",
+			N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", p.token)
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+
+	prevCfg, prevProvider := cfg, oidcProvider
+	t.Cleanup(func() { cfg, oidcProvider = prevCfg, prevProvider })
+	cfg.OIDC = oidcConfig{
+		Issuer:      p.srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://forum.test/auth/oidc/callback",
+		Scopes:      "openid email profile",
+	}
+	oidcProvider = newOIDCClient(cfg.OIDC)
+	return p
+}
+
+func (p *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if r.ParseForm() != nil || r.PostForm.Get("client_id") != testClientID {
+		fail("invalid_client")
+		return
+	}
+	p.mu.Lock()
+	g, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || pkceChallenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		fail("invalid_grant")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(g.claims)})
+}
+
+// sign issues an RS256 ID token.
+func (p *testIdP) sign(claims map[string]any) string {
+	p.t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	body, err := json.Marshal(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	signed := b64([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// claims are what the provider says about a signed-in user for the login
+// request q; tests change them to produce bad tokens.
+func (p *testIdP) claims(q url.Values, sub, email string) map[string]any {
+	return map[string]any{
+		"iss":            p.srv.URL,
+		"aud":            testClientID,
+		"sub":            sub,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          q.Get("nonce"),
+		"email":          email,
+		"email_verified": false,
+	}
+}
+
+// authorize returns a code for claims, bound to the PKCE challenge.
+func (p *testIdP) authorize(challenge string, claims map[string]any) string {
+	code := randomToken(8)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codes[code] = idpGrant{challenge, claims}
+	return code
+}
+
+// startOIDCLogin begins a sign-in and returns the flow cookie and the query
+// the forum sent the browser to the provider with.
+func startOIDCLogin(a *testAPI, idp *testIdP) (*http.Cookie, url.Values) {
+	a.t.Helper()
+	rec := a.do("GET", "/auth/oidc/login", "", nil)
+	expectStatus(a.t, rec, http.StatusFound)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), idp.srv.URL+"/authorize?") {
+		a.t.Fatalf("redirected to %q", rec.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+		a.t.Fatalf("authorization request %v", q)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcFlowCookie {
+			return c, q
+		}
+	}
+	a.t.Fatal("no flow cookie")
+	return nil, nil
+}
+
+func oidcCallback(a *testAPI, cookie *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	return a.do("GET", "/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), "", nil,
+		"Cookie", cookie.Name+"="+cookie.Value)
+}
+
+// TestOIDCCallbackRejects covers every way a callback is refused before
+// the forum looks up the account.
+func TestOIDCCallbackRejects(t *testing.T) {
+	a := newTestAPI(t)
+	idp := newTestIdP(t)
+
+	tests := []struct {
+		name   string
+		mutate func(challenge, state *string, claims map[string]any)
+		status int
+		code   string
+	}{
+		{"state mismatch", func(_, state *string, _ map[string]any) {
+			*state = "forged"
+		}, http.StatusBadRequest, "oidc_state_invalid"},
+		{"wrong PKCE verifier", func(challenge, _ *string, _ map[string]any) {
+			// the code was issued to another login
+			*challenge = pkceChallenge("someone else's verifier")
+		}, http.StatusBadGateway, "oidc_exchange_failed"},
+		{"nonce mismatch", func(_, _ *string, claims map[string]any) {
+			claims["nonce"] = "replayed"
+		}, http.StatusUnauthorized, "oidc_invalid_token"},
+		{"expired", func(_, _ *string, claims map[string]any) {
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		}, http.StatusUnauthorized, "oidc_invalid_token"},
+		{"bad audience", func(_, _ *string, claims map[string]any) {
+			claims["aud"] = []string{"another-app"}
+		}, http.StatusUnauthorized, "oidc_invalid_token"},
+		{"wrong issuer", func(_, _ *string, claims map[string]any) {
+			claims["iss"] = "https://evil.example"
+		}, http.StatusUnauthorized, "oidc_invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookie, q := startOIDCLogin(a, idp)
+			challenge, state := q.Get("code_challenge"), q.Get("state")
+			claims := idp.claims(q, "sub-1", "ada@example.com")
+			tt.mutate(&challenge, &state, claims)
+			code := idp.authorize(challenge, claims)
+			expectProblem(t, oidcCallback(a, cookie, code, state), tt.status, tt.code)
+		})
+	}
+
+	// a tampered flow cookie is refused like a wrong state
+	cookie, q := startOIDCLogin(a, idp)
+	cookie.Value = strings.Replace(cookie.Value, ".", ".x", 1)
+	code := idp.authorize(q.Get("code_challenge"), idp.claims(q, "sub-1", "ada@example.com"))
+	expectProblem(t, oidcCallback(a, cookie, code, q.Get("state")), http.StatusBadRequest, "oidc_state_invalid")
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	q := url.Values{"nonce": {"n1"}}
+
+	claims := idp.claims(q, "sub-1", "ada@example.com")
+	got, err := oidcProvider.verifyIDToken(t.Context(), idp.sign(claims), "n1")
+	if err != nil || got.Subject != "sub-1" || got.Email != "ada@example.com" {
+		t.Fatalf("verifyIDToken = %+v, %v", got, err)
+	}
+
+	// tokens signed by another key or with an HMAC alg are never accepted
+	other := &testIdP{t: t}
+	other.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := oidcProvider.verifyIDToken(t.Context(), other.sign(claims), "n1"); err == nil {
+		t.Error("token signed with an unknown key accepted")
+	}
+	parts := strings.Split(idp.sign(claims), ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"k1"}`))
+	if _, err := oidcProvider.verifyIDToken(t.Context(), strings.Join(parts, "."), "n1"); err == nil {
+		t.Error("HS256 token accepted")
+	}
+}
+
+// openTestPostgres points db and store at the Postgres database named by
+// TEST_DATABASE_URL, migrated to the latest version, and skips the test
+// when none is given. Tests must not depend on the database being empty.
+func openTestPostgres(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	prevDB, prevDriver, prevStore := db, dbDriver, store
+	t.Cleanup(func() { db, dbDriver, store = prevDB, prevDriver, prevStore })
+	if err := openDatabase(url); err != nil {
+		t.Fatal(err)
+	}
+	conn := db
+	t.Cleanup(func() { conn.Close() })
+	if _, err := migrateUp(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCAccounts(t *testing.T) {
+	a := newTestAPI(t)
+	openTestPostgres(t)
+	a.h = routes()
+	idp := newTestIdP(t)
+	run := fmt.Sprint(time.Now().UnixNano())
+
+	login := func(sub, email string, verified bool) *httptest.ResponseRecorder {
+		t.Helper()
+		cookie, q := startOIDCLogin(a, idp)
+		claims := idp.claims(q, sub+run, email)
+		claims["email_verified"] = verified
+		claims["preferred_username"] = "sso" + run[len(run)-8:]
+		code := idp.authorize(q.Get("code_challenge"), claims)
+		return oidcCallback(a, cookie, code, q.Get("state"))
+	}
+	me := func(token string) User {
+		t.Helper()
+		pl, err := parseToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := store.UserByID(t.Context(), pl.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// an unknown identity gets a new account without a password
+	rec := login("new-", "new-"+run+"@example.com", true)
+	expectStatus(t, rec, http.StatusOK)
+	first := me(decodeBody[map[string]string](t, rec)["token"])
+	rec = login("new-", "new-"+run+"@example.com", true)
+	expectStatus(t, rec, http.StatusOK)
+	if again := me(decodeBody[map[string]string](t, rec)["token"]); again.ID != first.ID {
+		t.Fatalf("second login got user %d, want %d", again.ID, first.ID)
+	}
+
+	// it can set a first password without knowing a current one
+	token := decodeBody[map[string]string](t, rec)["token"]
+	expectStatus(t, a.do("PUT", "/me/password", token, map[string]string{"new_password": "correct horse"}), http.StatusNoContent)
+	expectProblem(t, a.do("PUT", "/me/password", token, map[string]string{"new_password": "battery staple"}),
+		http.StatusForbidden, "wrong_password")
+
+	// an unverified email that belongs to a password account isn't linked
+	owner := "owner-" + run + "@example.com"
+	expectStatus(t, a.do("POST", "/register", "", map[string]string{"name": "owner" + run[len(run)-8:], "email": owner, "password": "hunter22"}), http.StatusOK)
+	expectProblem(t, login("taken-", owner, false), http.StatusConflict, "email_taken")
+
+	// a verified one is
+	rec = login("taken-", owner, true)
+	expectStatus(t, rec, http.StatusOK)
+	if u := me(decodeBody[map[string]string](t, rec)["token"]); u.Email != owner {
+		t.Fatalf("linked to %+v", u)
+	}
+
+	// an unverified email doesn't claim the address for whoever verifies it later
+	victim := "victim-" + run + "@example.com"
+	rec = login("squatter-", victim, false)
+	expectStatus(t, rec, http.StatusOK)
+	squatter := me(decodeBody[map[string]string](t, rec)["token"])
+	if !strings.HasSuffix(squatter.Email, ".invalid") {
+		t.Fatalf("unverified email stored as %q", squatter.Email)
+	}
+	rec = login("victim-", victim, true)
+	expectStatus(t, rec, http.StatusOK)
+	if u := me(decodeBody[map[string]string](t, rec)["token"]); u.ID == squatter.ID || u.Email != victim {
+		t.Fatalf("verified login got %+v, squatter is %d", u, squatter.ID)
+	}
+}
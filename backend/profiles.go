@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ---------- Public profiles ----------
+
+type Profile struct {
+	ID          int     `json:"id"`
+	Username    string  `json:"name"`
+	DisplayName string  `json:"display_name"`
+	AvatarURL   string  `json:"avatar_url"`
+	Bio         string  `json:"bio"`
+	Website     string  `json:"website"`
+	Location    string  `json:"location"`
+	CreatedAt   string  `json:"created_at"`
+	LastSeenAt  *string `json:"last_seen_at"`
+	TrustLevel  int     `json:"trust_level"`
+	TopicCount  int     `json:"topic_count"`
+	ReplyCount  int     `json:"reply_count"`
+}
+
+const (
+	maxDisplayNameLen = 50
+	maxBioLen         = 1000
+	maxWebsiteLen     = 200
+	maxLocationLen    = 100
+	lastSeenInterval  = 5 * time.Minute
+)
+
+// lastSeen throttles last_seen_at writes to one per user per interval.
+var lastSeen sync.Map // user ID -> time.Time
+
+func touchLastSeen(ctx context.Context, uid int) {
+	now := time.Now()
+	if v, ok := lastSeen.Load(uid); ok && now.Sub(v.(time.Time)) < lastSeenInterval {
+		return
+	}
+	lastSeen.Store(uid, now)
+	if err := store.TouchLastSeen(ctx, uid); err != nil {
+		slog.ErrorContext(ctx, "last seen update failed", "user_id", uid, "err", err)
+	}
+}
+
+// resolveUserRef accepts either a numeric ID or a username. Usernames can't
+// be all digits, so a numeric ref is always an ID.
+func resolveUserRef(ctx context.Context, ref string) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var id int
+	if n, err := strconv.Atoi(ref); err == nil {
+		err = db.QueryRowContext(ctx, `SELECT id FROM users WHERE id=$1`, n).Scan(&id)
+		return id, err
+	}
+	err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE username=$1`, ref).Scan(&id)
+	return id, err
+}
+
+// userFromRef resolves the {ref} path value. When there's no such user it
+// answers 404, or redirects if ref is a former username, and returns false.
+func userFromRef(w http.ResponseWriter, r *http.Request) (int, bool) {
+	ref := r.PathValue("ref")
+	id, err := resolveUserRef(r.Context(), ref)
+	if err == sql.ErrNoRows {
+		if !redirectRenamedUser(w, r, ref) {
+			writeError(w, 404, "user_not_found", "User not found")
+		}
+		return 0, false
+	}
+	if err != nil {
+		serverError(w, "USER LOOKUP", err)
+		return 0, false
+	}
+	return id, true
+}
+
+func loadProfile(ctx context.Context, id int) (Profile, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var p Profile
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			u.id, u.username, u.display_name, COALESCE(u.avatar_url, ''),
+			u.bio, u.website, u.location,
+			to_char(u.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(u.last_seen_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			u.trust_level,
+			(SELECT COUNT(*) FROM topics t WHERE t.user_id = u.id AND t.status = 'published'),
+			(SELECT COUNT(*) FROM replies r WHERE r.user_id = u.id AND r.status = 'published')
+		FROM users u
+		WHERE u.id=$1
+	`, id).Scan(
+		&p.ID, &p.Username, &p.DisplayName, &p.AvatarURL,
+		&p.Bio, &p.Website, &p.Location,
+		&p.CreatedAt, &p.LastSeenAt, &p.TrustLevel,
+		&p.TopicCount, &p.ReplyCount,
+	)
+	return p, err
+}
+
+// ---------- /users/{ref} ----------
+func userProfileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, ok := userFromRef(w, r)
+	if !ok {
+		return
+	}
+	p, err := loadProfile(ctx, id)
+	if err != nil {
+		serverError(w, "PROFILE", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// ---------- /users/{ref}/topics ----------
+func userTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	id, ok := userFromRef(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := pageParams(r, 20, 100)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			t.id, t.title, t.content, t.user_id,
+			u.username, COALESCE(u.avatar_url, '') AS avatar_url,
+			to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+			(SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id AND r.status='published') AS reply_count,
+			t.status
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.user_id=$1 AND t.status='published'
+		ORDER BY t.created_at DESC
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		serverError(w, "USER TOPICS", err)
+		return
+	}
+	defer rows.Close()
+
+	topics := []Topic{}
+	for rows.Next() {
+		var t Topic
+		if err := rows.Scan(&t.ID, &t.Title, &t.Content, &t.UserID,
+			&t.AuthorName, &t.AuthorAvatarURL, &t.CreatedAt, &t.ReplyCount, &t.Status); err != nil {
+			serverError(w, "USER TOPICS SCAN", err)
+			return
+		}
+		topics = append(topics, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(topics)
+}
+
+// ---------- /users/{ref}/replies ----------
+func userRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	id, ok := userFromRef(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := pageParams(r, 20, 100)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			r.id, r.topic_id, r.content, r.user_id,
+			u.username, COALESCE(u.avatar_url, '') AS avatar_url,
+			to_char(r.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+			r.status
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		JOIN topics t ON t.id = r.topic_id
+		WHERE r.user_id=$1 AND r.status='published' AND t.status='published'
+		ORDER BY r.created_at DESC
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		serverError(w, "USER REPLIES", err)
+		return
+	}
+	defer rows.Close()
+
+	replies := []Reply{}
+	for rows.Next() {
+		var rp Reply
+		if err := rows.Scan(&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+			&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status); err != nil {
+			serverError(w, "USER REPLIES SCAN", err)
+			return
+		}
+		replies = append(replies, rp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(replies)
+}
+
+// ---------- PATCH /me ----------
+
+func validateProfileField(name string, v *string, max int) *FieldError {
+	if v == nil {
+		return nil
+	}
+	*v = strings.TrimSpace(*v)
+	if utf8.RuneCountInString(*v) > max {
+		return &FieldError{name, "too_long", "must be at most " + strconv.Itoa(max) + " characters"}
+	}
+	if strings.ContainsFunc(*v, func(r rune) bool { return r < 0x20 && r != '\n' }) {
+		return &FieldError{name, "invalid_characters", "contains control characters"}
+	}
+	return nil
+}
+
+func validateWebsite(v *string) *FieldError {
+	if v == nil || *v == "" {
+		return nil
+	}
+	if fe := validateProfileField("website", v, maxWebsiteLen); fe != nil {
+		return fe
+	}
+	u, err := url.Parse(*v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &FieldError{"website", "invalid_url", "must be an http(s) URL"}
+	}
+	return nil
+}
+
+func updateMeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	// nil means "leave unchanged", "" clears the field
+	var payload struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		Website     *string `json:"website"`
+		Location    *string `json:"location"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	var invalid []FieldError
+	for _, fe := range []*FieldError{
+		validateProfileField("display_name", payload.DisplayName, maxDisplayNameLen),
+		validateProfileField("bio", payload.Bio, maxBioLen),
+		validateWebsite(payload.Website),
+		validateProfileField("location", payload.Location, maxLocationLen),
+	} {
+		if fe != nil {
+			invalid = append(invalid, *fe)
+		}
+	}
+	if payload.DisplayName != nil && strings.Contains(*payload.DisplayName, "\n") {
+		invalid = append(invalid, FieldError{"display_name", "invalid_characters", "must be a single line"})
+	}
+	if len(invalid) > 0 {
+		invalidFields(w, invalid...)
+		return
+	}
+
+	toNull := func(s *string) sql.NullString {
+		if s == nil {
+			return sql.NullString{}
+		}
+		return sql.NullString{String: *s, Valid: true}
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE users SET
+			display_name = COALESCE($1, display_name),
+			bio          = COALESCE($2, bio),
+			website      = COALESCE($3, website),
+			location     = COALESCE($4, location)
+		WHERE id=$5
+	`, toNull(payload.DisplayName), toNull(payload.Bio), toNull(payload.Website), toNull(payload.Location), uid); err != nil {
+		serverError(w, "PROFILE UPDATE", err)
+		return
+	}
+
+	p, err := loadProfile(ctx, uid)
+	if err != nil {
+		serverError(w, "PROFILE", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
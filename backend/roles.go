@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// ---------- Roles ----------
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+func userRole(ctx context.Context, uid int) (string, error) {
+	_, role, err := store.UserAccess(ctx, uid)
+	return role, err
+}
+
+// requireRole is requireAuth plus a check that the caller has one of roles.
+// The role is looked up on every request so demotions take effect at once.
+func requireRole(next http.Handler, roles ...string) http.Handler {
+	return requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		role, err := userRole(ctx, getUserID(r))
+		if err != nil {
+			slog.ErrorContext(ctx, "role lookup failed", "err", err)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		allowed := false
+		for _, want := range roles {
+			if role == want {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+			return
+		}
+
+		// admin policy may demand 2FA before privileged endpoints unlock
+		if required, err := roleRequires2FA(ctx, role); err != nil {
+			serverError(w, "2FA POLICY", err)
+			return
+		} else if required {
+			enabled, err := totpEnabled(ctx, getUserID(r))
+			if err != nil {
+				serverError(w, "2FA POLICY", err)
+				return
+			}
+			if !enabled {
+				writeError(w, http.StatusForbidden, "2fa_required", "Enable two-factor authentication to use this feature")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
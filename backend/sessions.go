@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ---------- Sessions ----------
+//
+// Every login creates a sessions row whose ID is embedded in the signed token.
+// requireAuth checks the row, so revoking it logs that device out even though
+// the token itself is still validly signed.
+
+func randomToken(nbytes int) string {
+	b := make([]byte, nbytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashToken is used for secrets we hand out once and only need to look up
+// later (email confirmation links and the like).
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for uid and returns a signed token.
+func createSession(uid int, r *http.Request) (string, error) {
+	ctx := r.Context()
+	sid := randomToken(16)
+	if err := store.CreateSession(ctx, sid, uid, time.Now().Add(cfg.Tokens.SessionTTL), clientIP(r), r.UserAgent()); err != nil {
+		return "", err
+	}
+	loginsStarted.Inc()
+	return makeToken(uid, sid)
+}
+
+func sessionActive(ctx context.Context, sid string, uid int) bool {
+	ok, err := store.SessionActive(ctx, sid, uid)
+	if err != nil {
+		slog.ErrorContext(ctx, "session lookup failed", "user_id", uid, "err", err)
+	}
+	return ok
+}
+
+// revokeSessions revokes all of the user's sessions except keep ("" revokes
+// everything).
+func revokeSessions(ctx context.Context, uid int, keep string) error {
+	return store.RevokeSessions(ctx, uid, keep)
+}
+
+func sessionSweepLoop(ctx context.Context, every time.Duration) {
+	runEvery(ctx, "session-sweep", every, false, func(ctx context.Context) {
+		if err := store.SweepSessions(ctx, time.Now().Add(-7*24*time.Hour)); err != nil {
+			slog.ErrorContext(ctx, "session sweep failed", "err", err)
+		}
+		// pending email changes only exist on Postgres
+		if dbDriver != driverPostgres {
+			return
+		}
+		ctx, cancel := dbCtx(ctx)
+		defer cancel()
+		if _, err := db.ExecContext(ctx, `DELETE FROM email_changes WHERE expires_at < NOW()`); err != nil {
+			slog.ErrorContext(ctx, "session sweep failed", "err", err)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------- Background work & shutdown ----------
+//
+// Goroutines that outlive a request are started with goLoop or goJob so a
+// shutdown can wait for them. Loops get a context that is cancelled as soon
+// as shutdown begins and return before their next run; jobs such as export
+// archives and mail are left to finish, up to the shutdown timeout.
+
+var (
+	background                    sync.WaitGroup
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+)
+
+// goLoop runs a periodic worker until shutdown.
+func goLoop(fn func(ctx context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn(backgroundCtx)
+	}()
+}
+
+// goJob runs a one-off job that shutdown waits for. The job's span joins the
+// trace in ctx (usually the request that queued it), but the job isn't
+// cancelled along with ctx.
+func goJob(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), "job "+name)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer span.End()
+		fn(ctx)
+	}()
+}
+
+// runEvery calls fn every interval (and once up front with now) until ctx
+// is cancelled. Each run is traced as its own "job <name>" span.
+func runEvery(ctx context.Context, name string, every time.Duration, now bool, fn func(ctx context.Context)) {
+	run := func() {
+		ctx, span := tracer.Start(ctx, "job "+name, trace.WithNewRoot())
+		defer span.End()
+		fn(ctx)
+	}
+	if now {
+		run()
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			run()
+		}
+	}
+}
+
+// drainBackground stops the loops and waits for every background goroutine,
+// giving up when ctx expires.
+func drainBackground(ctx context.Context) error {
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listenAndServe runs the servers until SIGINT or SIGTERM, then stops
+// accepting connections, lets in-flight requests and background work finish
+// within the shutdown timeout and closes the database. A second signal
+// exits at once.
+func listenAndServe(servers ...*http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	select {
+	case err := <-errc:
+		fatal("server failed", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown: requests still running", "addr", srv.Addr, "err", err)
+		}
+	}
+	if err := drainBackground(ctx); err != nil {
+		slog.Error("shutdown: background work still running", "err", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("shutdown: closing database failed", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
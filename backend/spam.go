@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Spam filtering ----------
+//
+// Every topic/reply create or edit runs through spamFilter. A post that any
+// checker flags is stored with status "pending" and only shows up once a
+// moderator approves it.
+
+type SpamInput struct {
+	Kind        string // "topic" or "reply"
+	UserID      int
+	AuthorName  string
+	AuthorEmail string
+	AccountAge  time.Duration
+	IP          string
+	UserAgent   string
+	Referrer    string
+	Title       string
+	Content     string
+}
+
+func (in SpamInput) text() string {
+	if in.Title == "" {
+		return in.Content
+	}
+	return in.Title + "\n" + in.Content
+}
+
+type SpamResult struct {
+	Spam   bool
+	Reason string
+}
+
+// SpamChecker decides whether a post looks like spam.
+type SpamChecker interface {
+	Check(ctx context.Context, in SpamInput) (SpamResult, error)
+}
+
+// spamChain runs checkers in order and stops at the first positive result.
+// Checker errors are logged and skipped: an unreachable external service must
+// not block posting.
+type spamChain []SpamChecker
+
+func (c spamChain) Check(ctx context.Context, in SpamInput) (SpamResult, error) {
+	for _, ch := range c {
+		res, err := ch.Check(ctx, in)
+		if err != nil {
+			slog.ErrorContext(ctx, "spam check failed", "checker", fmt.Sprintf("%T", ch), "err", err)
+			continue
+		}
+		if res.Spam {
+			return res, nil
+		}
+	}
+	return SpamResult{}, nil
+}
+
+var spamFilter SpamChecker = spamChain{}
+
+// ---------- link-count rule ----------
+
+var linkRe = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+
+type linkRule struct {
+	MaxLinks        int
+	NewAccountAge   time.Duration
+	NewAccountLinks int
+}
+
+func (l linkRule) Check(_ context.Context, in SpamInput) (SpamResult, error) {
+	n := len(linkRe.FindAllStringIndex(in.text(), -1))
+	limit := l.MaxLinks
+	if in.AccountAge < l.NewAccountAge {
+		limit = l.NewAccountLinks
+	}
+	if n > limit {
+		return SpamResult{Spam: true, Reason: fmt.Sprintf("too many links (%d > %d)", n, limit)}, nil
+	}
+	return SpamResult{}, nil
+}
+
+// ---------- keyword / regex rules ----------
+
+type keywordRule struct {
+	patterns []*regexp.Regexp
+}
+
+// loadKeywordRule reads one pattern per line. Plain words are matched
+// case-insensitively on word boundaries; lines wrapped in slashes (/.../) are
+// used as regular expressions. Blank lines and # comments are ignored.
+func loadKeywordRule(r io.Reader) (keywordRule, error) {
+	var kr keywordRule
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		var expr string
+		if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+			expr = s[1 : len(s)-1]
+		} else {
+			expr = `(?i)\b` + regexp.QuoteMeta(s) + `\b`
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return kr, fmt.Errorf("line %d: %w", line, err)
+		}
+		kr.patterns = append(kr.patterns, re)
+	}
+	return kr, sc.Err()
+}
+
+func (k keywordRule) Check(_ context.Context, in SpamInput) (SpamResult, error) {
+	text := in.text()
+	for _, re := range k.patterns {
+		if re.MatchString(text) {
+			return SpamResult{Spam: true, Reason: "matched rule " + re.String()}, nil
+		}
+	}
+	return SpamResult{}, nil
+}
+
+// ---------- naive Bayes ----------
+
+const (
+	bayesMinDocs   = 10   // per class before the classifier votes at all
+	bayesThreshold = 0.95 // spam probability needed to flag a post
+)
+
+type bayesCounts struct{ spam, ham int }
+
+type bayesFilter struct {
+	mu       sync.RWMutex
+	tokens   map[string]*bayesCounts
+	spamDocs int
+	hamDocs  int
+}
+
+func newBayesFilter() *bayesFilter {
+	return &bayesFilter{tokens: map[string]*bayesCounts{}}
+}
+
+var bayes = newBayesFilter()
+
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-'
+	})
+	seen := map[string]bool{}
+	var out []string
+	for _, w := range words {
+		w = strings.Trim(w, ".-")
+		if len(w) < 2 || len(w) > 40 || seen[w] {
+			continue
+		}
+		seen[w] = true
+		out = append(out, w)
+	}
+	return out
+}
+
+// load replaces the in-memory model with the counts stored in the database.
+func (b *bayesFilter) load(ctx context.Context) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `SELECT token, spam_count, ham_count FROM spam_tokens`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tokens := map[string]*bayesCounts{}
+	for rows.Next() {
+		var tok string
+		var c bayesCounts
+		if err := rows.Scan(&tok, &c.spam, &c.ham); err != nil {
+			return err
+		}
+		tokens[tok] = &c
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var spamDocs, hamDocs int
+	_ = db.QueryRowContext(ctx, `SELECT COALESCE(SUM(docs) FILTER (WHERE class='spam'), 0),
+		COALESCE(SUM(docs) FILTER (WHERE class='ham'), 0) FROM spam_classes`).Scan(&spamDocs, &hamDocs)
+
+	b.mu.Lock()
+	b.tokens, b.spamDocs, b.hamDocs = tokens, spamDocs, hamDocs
+	b.mu.Unlock()
+	return nil
+}
+
+// train records a moderator decision on a post in memory and in the
+// database. Each post counts once: deciding it the same way again changes
+// nothing, and reversing a decision takes back what the earlier one taught.
+func (b *bayesFilter) train(ctx context.Context, kind string, id int, text string, spam bool) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	toks := tokenize(text)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prevSpam bool
+	var prevToks []string
+	err = tx.QueryRowContext(ctx, `SELECT spam, tokens FROM spam_training WHERE kind=$1 AND post_id=$2 FOR UPDATE`,
+		kind, id).Scan(&prevSpam, pq.Array(&prevToks))
+	trained := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if trained && prevSpam == spam {
+		return nil
+	}
+	if trained {
+		if err := countTokens(ctx, tx, prevToks, prevSpam, -1); err != nil {
+			return err
+		}
+	}
+	if err := countTokens(ctx, tx, toks, spam, 1); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO spam_training (kind, post_id, spam, tokens) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, post_id) DO UPDATE SET spam = EXCLUDED.spam, tokens = EXCLUDED.tokens
+	`, kind, id, spam, pq.Array(toks)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trained {
+		b.count(prevToks, prevSpam, -1)
+	}
+	b.count(toks, spam, 1)
+	return nil
+}
+
+// countTokens adds delta to the stored counts of one document's tokens.
+func countTokens(ctx context.Context, tx *sql.Tx, toks []string, spam bool, delta int) error {
+	class, col := "ham", "ham_count"
+	if spam {
+		class, col = "spam", "spam_count"
+	}
+	for _, tok := range toks {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO spam_tokens (token, `+col+`) VALUES ($1, GREATEST($2, 0))
+			ON CONFLICT (token) DO UPDATE SET `+col+` = GREATEST(spam_tokens.`+col+` + $2, 0)
+		`, tok, delta); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO spam_classes (class, docs) VALUES ($1, GREATEST($2, 0))
+		ON CONFLICT (class) DO UPDATE SET docs = GREATEST(spam_classes.docs + $2, 0)
+	`, class, delta)
+	return err
+}
+
+// count adds delta to the in-memory counts; the caller holds b.mu.
+func (b *bayesFilter) count(toks []string, spam bool, delta int) {
+	for _, tok := range toks {
+		c := b.tokens[tok]
+		if c == nil {
+			c = &bayesCounts{}
+			b.tokens[tok] = c
+		}
+		if spam {
+			c.spam = max(c.spam+delta, 0)
+		} else {
+			c.ham = max(c.ham+delta, 0)
+		}
+	}
+	if spam {
+		b.spamDocs = max(b.spamDocs+delta, 0)
+	} else {
+		b.hamDocs = max(b.hamDocs+delta, 0)
+	}
+}
+
+// score returns P(spam | text) and whether the model had enough data to say.
+func (b *bayesFilter) score(text string) (float64, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.spamDocs < bayesMinDocs || b.hamDocs < bayesMinDocs {
+		return 0, false
+	}
+
+	total := float64(b.spamDocs + b.hamDocs)
+	logSpam := math.Log(float64(b.spamDocs) / total)
+	logHam := math.Log(float64(b.hamDocs) / total)
+	for _, tok := range tokenize(text) {
+		c := b.tokens[tok]
+		if c == nil {
+			continue
+		}
+		// Laplace smoothing over the two outcomes "document has token" / "doesn't"
+		logSpam += math.Log((float64(c.spam) + 1) / (float64(b.spamDocs) + 2))
+		logHam += math.Log((float64(c.ham) + 1) / (float64(b.hamDocs) + 2))
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam)), true
+}
+
+func (b *bayesFilter) Check(_ context.Context, in SpamInput) (SpamResult, error) {
+	p, ok := b.score(in.text())
+	if ok && p >= bayesThreshold {
+		return SpamResult{Spam: true, Reason: fmt.Sprintf("classifier score %.2f", p)}, nil
+	}
+	return SpamResult{}, nil
+}
+
+// ---------- Akismet-style HTTP service ----------
+
+type akismetChecker struct {
+	Endpoint string // e.g. https://rest.akismet.com
+	Key      string
+	Site     string
+	Client   *http.Client
+}
+
+func (a akismetChecker) Check(ctx context.Context, in SpamInput) (SpamResult, error) {
+	form := url.Values{
+		"api_key":              {a.Key},
+		"blog":                 {a.Site},
+		"user_ip":              {in.IP},
+		"user_agent":           {in.UserAgent},
+		"referrer":             {in.Referrer},
+		"comment_type":         {"forum-post"},
+		"comment_author":       {in.AuthorName},
+		"comment_author_email": {in.AuthorEmail},
+		"comment_content":      {in.text()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(a.Endpoint, "/")+"/1.1/comment-check", strings.NewReader(form.Encode()))
+	if err != nil {
+		return SpamResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return SpamResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return SpamResult{}, err
+	}
+	switch strings.TrimSpace(string(body)) {
+	case "true":
+		return SpamResult{Spam: true, Reason: "flagged by " + a.Endpoint}, nil
+	case "false":
+		return SpamResult{}, nil
+	default:
+		return SpamResult{}, fmt.Errorf("unexpected response %d: %q (%s)",
+			resp.StatusCode, body, resp.Header.Get("X-akismet-debug-help"))
+	}
+}
+
+// ---------- wiring ----------
+
+// newSpamFilter builds the checker chain. On Postgres the link rule and the
+// Bayes classifier are always on; keyword rules and the external service are
+// enabled by spam.rules_file and spam.akismet_key.
+func newSpamFilter(c SpamConfig) (SpamChecker, error) {
+	// every checker holds posts for moderation, which needs Postgres; on
+	// SQLite a held post could never be reviewed, so nothing is held
+	if dbDriver != driverPostgres {
+		slog.Warn("SQLite backend: spam filtering is off because moderation is unavailable")
+		return spamChain{}, nil
+	}
+
+	chain := spamChain{
+		linkRule{
+			MaxLinks:        c.MaxLinks,
+			NewAccountAge:   24 * time.Hour,
+			NewAccountLinks: c.NewAccountMaxLinks,
+		},
+	}
+
+	if path := c.RulesFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		kr, err := loadKeywordRule(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		chain = append(chain, kr)
+	}
+
+	// the Bayes model is trained by moderation
+	if err := bayes.load(context.Background()); err != nil {
+		slog.Error("spam model load failed", "err", err)
+	}
+	chain = append(chain, bayes)
+
+	if c.AkismetKey != "" {
+		chain = append(chain, akismetChecker{
+			Endpoint: c.AkismetURL,
+			Key:      c.AkismetKey,
+			Site:     cfg.SiteURL,
+			Client:   &http.Client{Timeout: 5 * time.Second, Transport: tracedTransport()},
+		})
+	}
+	return chain, nil
+}
+
+// checkSpam builds the checker input for the signed-in author and returns the
+// status the post should be stored with.
+func checkSpam(r *http.Request, kind string, uid int, title, content string) (string, error) {
+	ctx := r.Context()
+	in := SpamInput{
+		Kind:      kind,
+		UserID:    uid,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Referrer:  r.Referer(),
+		Title:     title,
+		Content:   content,
+	}
+	u, err := store.UserByID(ctx, uid)
+	if err != nil {
+		return "", err
+	}
+	in.AuthorName, in.AuthorEmail = u.Username, u.Email
+	in.AccountAge = time.Since(u.CreatedAt)
+
+	res, err := spamFilter.Check(r.Context(), in)
+	if err != nil {
+		return "", err
+	}
+	if res.Spam {
+		slog.InfoContext(r.Context(), "spam held", "kind", kind, "user_id", uid, "reason", res.Reason)
+		return "pending", nil
+	}
+	return "published", nil
+}
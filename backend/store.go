@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/XSAM/otelsql"
+)
+
+// ---------- Storage ----------
+//
+// Handlers for users, topics, replies and sessions go through store instead
+// of querying db directly. main uses the Postgres implementation; tests use
+// the in-memory one so handler behaviour can be checked without a database.
+// Timestamps in returned records are already formatted as ISO strings.
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrUsernameTaken = errors.New("username already exists")
+	ErrEmailTaken    = errors.New("email already exists")
+)
+
+type Store interface {
+	UserStore
+	TopicStore
+	ReplyStore
+	SessionStore
+}
+
+type UserStore interface {
+	// CreateUser inserts u with the given bcrypt hash and fills in its ID and
+	// CreatedAt. It returns ErrUsernameTaken or ErrEmailTaken on conflicts.
+	CreateUser(ctx context.Context, u *User, passwordHash string) error
+	// UserByEmail looks up a user by normalized email and returns the
+	// password hash alongside.
+	UserByEmail(ctx context.Context, email string) (User, string, error)
+	UserByID(ctx context.Context, id int) (User, error)
+	UserByName(ctx context.Context, username string) (User, error)
+	// UserAccess returns what capability checks need: trust level and role.
+	UserAccess(ctx context.Context, id int) (level int, role string, err error)
+	// UsernameReserved reports whether another user (not uid) used name
+	// before renaming.
+	UsernameReserved(ctx context.Context, name string, uid int) (bool, error)
+	TwoFactorEnabled(ctx context.Context, uid int) (bool, error)
+	// RefreshTrustLevel recalculates the user's trust level unless an admin
+	// has pinned it.
+	RefreshTrustLevel(ctx context.Context, uid int) error
+	SetAvatarURL(ctx context.Context, uid int, url string) error
+	TouchLastSeen(ctx context.Context, uid int) error
+	SetRole(ctx context.Context, uid int, role string) error
+	SetPasswordHash(ctx context.Context, uid int, hash string) error
+}
+
+type TopicStore interface {
+	// ListTopics returns published topics, newest first, with reply counts.
+	ListTopics(ctx context.Context) ([]Topic, error)
+	// SearchTopics matches q against titles, content and author names.
+	SearchTopics(ctx context.Context, q string) ([]Topic, error)
+	// Topic returns one topic; with publishedOnly, held or rejected topics
+	// are ErrNotFound.
+	Topic(ctx context.Context, id int, publishedOnly bool) (Topic, error)
+	TopicOwner(ctx context.Context, id int) (int, error)
+	CreateTopic(ctx context.Context, uid int, title, content, status string) (Topic, error)
+	// UpdateTopic and UpdateReply only apply status to published posts, so
+	// an edit can hold a post for review but never publishes one that is
+	// held or rejected. UpdateReply returns the status the reply ends up in.
+	UpdateTopic(ctx context.Context, id int, title, content, status string) (Topic, error)
+	DeleteTopic(ctx context.Context, id int) error
+	MarkTopicRead(ctx context.Context, uid, topicID int) error
+	// ReindexSearch rebuilds the search index where there is one.
+	ReindexSearch(ctx context.Context) error
+}
+
+type ReplyStore interface {
+	// ListReplies returns a topic's published replies, oldest first.
+	ListReplies(ctx context.Context, topicID int) ([]Reply, error)
+	ReplyOwner(ctx context.Context, id int) (int, error)
+	// CreateReply returns ErrNotFound when the topic doesn't exist.
+	CreateReply(ctx context.Context, uid, topicID int, content, status string) (Reply, error)
+	UpdateReply(ctx context.Context, id int, content, status string) (string, error)
+	DeleteReply(ctx context.Context, id int) error
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, sid string, uid int, expires time.Time, ip, userAgent string) error
+	SessionActive(ctx context.Context, sid string, uid int) (bool, error)
+	RevokeSession(ctx context.Context, sid string) error
+	// RevokeSessions revokes all of the user's sessions except keep.
+	RevokeSessions(ctx context.Context, uid int, keep string) error
+	// SweepSessions deletes sessions that expired before the given time.
+	SweepSessions(ctx context.Context, before time.Time) error
+}
+
+var store Store
+
+// ---------- Database selection ----------
+//
+// DATABASE_URL picks the backend by scheme: sqlite:forum.db (relative) or
+// sqlite:///var/lib/forum/forum.db (absolute) opens SQLite, anything else is
+// handed to the Postgres driver. SQLite covers the Store only; features that
+// query db directly need Postgres.
+
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+var dbDriver = driverPostgres
+
+// sqlitePragmas are applied to every SQLite connection.
+const sqlitePragmas = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// databaseDriver returns the driver and the DSN to hand to it.
+func databaseDriver(url string) (driver, dsn string) {
+	for _, prefix := range []string{"sqlite://", "sqlite3://", "sqlite:", "sqlite3:"} {
+		if path, ok := strings.CutPrefix(url, prefix); ok {
+			sep := "?"
+			if strings.Contains(path, "?") {
+				sep = "&"
+			}
+			return driverSQLite, "file:" + path + sep + sqlitePragmas
+		}
+	}
+	return driverPostgres, url
+}
+
+// openDatabase opens url and sets db, dbDriver and store. Postgres pools are
+// sized from cfg.Database.
+func openDatabase(url string) error {
+	driver, dsn := databaseDriver(url)
+	conn, err := otelsql.Open(driver, dsn, sqlTracing(driver)...)
+	if err != nil {
+		return err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return err
+	}
+	db, dbDriver = conn, driver
+	if driver == driverSQLite {
+		// one writer at a time anyway; a single connection also keeps
+		// :memory: databases from splitting per connection
+		db.SetMaxOpenConns(1)
+		store = newSQLiteStore(db)
+	} else {
+		db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+		db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+		db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+		store = newPGStore(db)
+	}
+	return nil
+}
+
+// dbCtx bounds a store call or a handler's queries by the configured query
+// timeout, on top of whatever deadline or cancellation ctx already carries.
+// Callers defer the cancel.
+func dbCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cfg.Database.QueryTimeout)
+}
+
+// isoTime formats t the way the SQL to_char(... 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+// calls do.
+func isoTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
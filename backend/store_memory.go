@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- In-memory store ----------
+//
+// A complete Store kept in maps behind one mutex, for tests and throwaway
+// local runs. It mirrors the Postgres behaviour handlers rely on: unique
+// usernames and emails, cascading topic deletes, published-only listings and
+// session expiry.
+
+type memUser struct {
+	User
+	hash        string
+	role        string
+	levelLocked bool
+	twoFactor   bool
+	lastSeen    time.Time
+	oldNames    []string
+}
+
+type memTopic struct {
+	ID        int
+	UserID    int
+	Title     string
+	Content   string
+	Status    string
+	CreatedAt time.Time
+}
+
+type memReply struct {
+	ID        int
+	TopicID   int
+	UserID    int
+	Content   string
+	Status    string
+	CreatedAt time.Time
+}
+
+type memSession struct {
+	UserID  int
+	Expires time.Time
+	Revoked bool
+}
+
+type memStore struct {
+	mu       sync.Mutex
+	nextID   int
+	users    map[int]*memUser
+	topics   map[int]*memTopic
+	replies  map[int]*memReply
+	reads    map[[2]int]bool // {user, topic}
+	sessions map[string]*memSession
+
+	// now is swapped in tests that need to move the clock.
+	now func() time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:    map[int]*memUser{},
+		topics:   map[int]*memTopic{},
+		replies:  map[int]*memReply{},
+		reads:    map[[2]int]bool{},
+		sessions: map[string]*memSession{},
+		now:      time.Now,
+	}
+}
+
+// newID hands out IDs from one sequence, which keeps them ordered by
+// creation across tables.
+func (s *memStore) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+// ----- test helpers -----
+
+// setTrustLevel pins a user's trust level, like the admin endpoint does.
+func (s *memStore) setTrustLevel(uid, level int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[uid]; u != nil {
+		u.TrustLevel, u.levelLocked = level, true
+	}
+}
+
+// ----- users -----
+
+func (s *memStore) CreateUser(ctx context.Context, u *User, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.users {
+		if other.Username == u.Username {
+			return ErrUsernameTaken
+		}
+		if strings.EqualFold(other.Email, u.Email) {
+			return ErrEmailTaken
+		}
+	}
+	u.ID = s.newID()
+	u.CreatedAt = s.now()
+	mu := &memUser{User: *u, hash: passwordHash, role: roleUser}
+	mu.Password = ""
+	s.users[u.ID] = mu
+	return nil
+}
+
+func (s *memStore) UserByEmail(ctx context.Context, email string) (User, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if strings.ToLower(u.Email) == email {
+			return u.User, u.hash, nil
+		}
+	}
+	return User{}, "", ErrNotFound
+}
+
+func (s *memStore) UserByID(ctx context.Context, id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[id]
+	if u == nil {
+		return User{}, ErrNotFound
+	}
+	return u.User, nil
+}
+
+func (s *memStore) UserByName(ctx context.Context, username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == username {
+			return u.User, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memStore) UserAccess(ctx context.Context, id int) (int, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[id]
+	if u == nil {
+		return 0, "", ErrNotFound
+	}
+	return u.TrustLevel, u.role, nil
+}
+
+func (s *memStore) UsernameReserved(ctx context.Context, name string, uid int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, u := range s.users {
+		if id == uid {
+			continue
+		}
+		for _, old := range u.oldNames {
+			if strings.EqualFold(old, name) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *memStore) TwoFactorEnabled(ctx context.Context, uid int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[uid]
+	return u != nil && u.twoFactor, nil
+}
+
+// RefreshTrustLevel applies computeTrustLevel to the stats the store keeps.
+// Flags aren't stored here, so none count against the user.
+func (s *memStore) RefreshTrustLevel(ctx context.Context, uid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[uid]
+	if u == nil || u.levelLocked {
+		return nil
+	}
+	st := trustStats{AccountAge: s.now().Sub(u.CreatedAt)}
+	for k := range s.reads {
+		if k[0] == uid {
+			st.TopicsRead++
+		}
+	}
+	for _, rp := range s.replies {
+		if rp.UserID == uid && rp.Status == "published" {
+			st.RepliesPosted++
+		}
+	}
+	u.TrustLevel = computeTrustLevel(st)
+	return nil
+}
+
+func (s *memStore) SetAvatarURL(ctx context.Context, uid int, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[uid]; u != nil {
+		u.AvatarURL = url
+	}
+	return nil
+}
+
+func (s *memStore) TouchLastSeen(ctx context.Context, uid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[uid]; u != nil {
+		u.lastSeen = s.now()
+	}
+	return nil
+}
+
+func (s *memStore) SetRole(ctx context.Context, uid int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[uid]
+	if u == nil {
+		return ErrNotFound
+	}
+	u.role = role
+	return nil
+}
+
+func (s *memStore) SetPasswordHash(ctx context.Context, uid int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[uid]
+	if u == nil {
+		return ErrNotFound
+	}
+	u.hash = hash
+	return nil
+}
+
+// ----- topics -----
+
+// topic renders t with its author and reply count; the lock must be held.
+func (s *memStore) topic(t *memTopic) Topic {
+	out := Topic{
+		ID: t.ID, Title: t.Title, Content: t.Content, UserID: t.UserID,
+		CreatedAt: isoTime(t.CreatedAt), Status: t.Status,
+	}
+	if u := s.users[t.UserID]; u != nil {
+		out.AuthorName, out.AuthorAvatarURL = u.Username, u.AvatarURL
+	}
+	for _, rp := range s.replies {
+		if rp.TopicID == t.ID && rp.Status == "published" {
+			out.ReplyCount++
+		}
+	}
+	return out
+}
+
+// publishedTopics returns published topics matching keep, newest first.
+func (s *memStore) publishedTopics(keep func(Topic) bool) []Topic {
+	var list []*memTopic
+	for _, t := range s.topics {
+		if t.Status == "published" {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].ID > list[j].ID
+	})
+	var out []Topic
+	for _, t := range list {
+		if rendered := s.topic(t); keep(rendered) {
+			out = append(out, rendered)
+		}
+	}
+	return out
+}
+
+func (s *memStore) ListTopics(ctx context.Context) ([]Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publishedTopics(func(Topic) bool { return true }), nil
+}
+
+func (s *memStore) SearchTopics(ctx context.Context, q string) ([]Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q = strings.ToLower(q)
+	return s.publishedTopics(func(t Topic) bool {
+		return strings.Contains(strings.ToLower(t.Title), q) ||
+			strings.Contains(strings.ToLower(t.Content), q) ||
+			strings.Contains(strings.ToLower(t.AuthorName), q)
+	}), nil
+}
+
+func (s *memStore) Topic(ctx context.Context, id int, publishedOnly bool) (Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.topics[id]
+	if t == nil || (publishedOnly && t.Status != "published") {
+		return Topic{}, ErrNotFound
+	}
+	return s.topic(t), nil
+}
+
+func (s *memStore) TopicOwner(ctx context.Context, id int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.topics[id]
+	if t == nil {
+		return 0, ErrNotFound
+	}
+	return t.UserID, nil
+}
+
+func (s *memStore) CreateTopic(ctx context.Context, uid int, title, content, status string) (Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &memTopic{ID: s.newID(), UserID: uid, Title: title, Content: content, Status: status, CreatedAt: s.now()}
+	s.topics[t.ID] = t
+	return s.topic(t), nil
+}
+
+func (s *memStore) UpdateTopic(ctx context.Context, id int, title, content, status string) (Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.topics[id]
+	if t == nil {
+		return Topic{}, ErrNotFound
+	}
+	t.Title, t.Content = title, content
+	if t.Status == "published" {
+		t.Status = status
+	}
+	return s.topic(t), nil
+}
+
+func (s *memStore) DeleteTopic(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.topics, id)
+	for rid, rp := range s.replies {
+		if rp.TopicID == id {
+			delete(s.replies, rid)
+		}
+	}
+	for k := range s.reads {
+		if k[1] == id {
+			delete(s.reads, k)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) MarkTopicRead(ctx context.Context, uid, topicID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads[[2]int{uid, topicID}] = true
+	return nil
+}
+
+func (s *memStore) ReindexSearch(ctx context.Context) error {
+	return nil
+}
+
+// ----- replies -----
+
+func (s *memStore) reply(rp *memReply) Reply {
+	out := Reply{
+		ID: rp.ID, TopicID: rp.TopicID, Content: rp.Content, UserID: rp.UserID,
+		CreatedAt: isoTime(rp.CreatedAt), Status: rp.Status,
+	}
+	if u := s.users[rp.UserID]; u != nil {
+		out.AuthorName, out.AuthorAvatarURL = u.Username, u.AvatarURL
+	}
+	return out
+}
+
+func (s *memStore) ListReplies(ctx context.Context, topicID int) ([]Reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*memReply
+	for _, rp := range s.replies {
+		if rp.TopicID == topicID && rp.Status == "published" {
+			list = append(list, rp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	var out []Reply
+	for _, rp := range list {
+		out = append(out, s.reply(rp))
+	}
+	return out, nil
+}
+
+func (s *memStore) ReplyOwner(ctx context.Context, id int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rp := s.replies[id]
+	if rp == nil {
+		return 0, ErrNotFound
+	}
+	return rp.UserID, nil
+}
+
+func (s *memStore) CreateReply(ctx context.Context, uid, topicID int, content, status string) (Reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topics[topicID] == nil {
+		return Reply{}, ErrNotFound
+	}
+	rp := &memReply{ID: s.newID(), TopicID: topicID, UserID: uid, Content: content, Status: status, CreatedAt: s.now()}
+	s.replies[rp.ID] = rp
+	return s.reply(rp), nil
+}
+
+func (s *memStore) UpdateReply(ctx context.Context, id int, content, status string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rp := s.replies[id]
+	if rp == nil {
+		return "", ErrNotFound
+	}
+	rp.Content = content
+	if rp.Status == "published" {
+		rp.Status = status
+	}
+	return rp.Status, nil
+}
+
+func (s *memStore) DeleteReply(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.replies, id)
+	return nil
+}
+
+// ----- sessions -----
+
+func (s *memStore) CreateSession(ctx context.Context, sid string, uid int, expires time.Time, ip, userAgent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sid] = &memSession{UserID: uid, Expires: expires}
+	return nil
+}
+
+func (s *memStore) SessionActive(ctx context.Context, sid string, uid int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := s.sessions[sid]
+	return ss != nil && ss.UserID == uid && !ss.Revoked && ss.Expires.After(s.now()), nil
+}
+
+func (s *memStore) RevokeSession(ctx context.Context, sid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ss := s.sessions[sid]; ss != nil {
+		ss.Revoked = true
+	}
+	return nil
+}
+
+func (s *memStore) RevokeSessions(ctx context.Context, uid int, keep string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sid, ss := range s.sessions {
+		if ss.UserID == uid && sid != keep {
+			ss.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memStore) SweepSessions(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sid, ss := range s.sessions {
+		if ss.Expires.Before(before) {
+			delete(s.sessions, sid)
+		}
+	}
+	return nil
+}
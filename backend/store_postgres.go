@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Postgres store ----------
+
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPGStore(db *sql.DB) *pgStore {
+	return &pgStore{db: db}
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ----- users -----
+
+func (s *pgStore) CreateUser(ctx context.Context, u *User, passwordHash string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO users (username, email, password_hash)
+		 VALUES ($1, $2, $3)
+		 RETURNING id, created_at`,
+		u.Username, u.Email, passwordHash,
+	).Scan(&u.ID, &u.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Constraint {
+		case "users_username_key":
+			return ErrUsernameTaken
+		case "users_email_key", "users_email_lower_key":
+			return ErrEmailTaken
+		}
+	}
+	return err
+}
+
+func (s *pgStore) UserByEmail(ctx context.Context, email string) (User, string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var u User
+	var hash string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, username, email, COALESCE(avatar_url, ''), password_hash, created_at, trust_level
+		 FROM users WHERE lower(email)=$1`,
+		email,
+	).Scan(&u.ID, &u.Username, &u.Email, &u.AvatarURL, &hash, &u.CreatedAt, &u.TrustLevel)
+	return u, hash, notFound(err)
+}
+
+func (s *pgStore) UserByID(ctx context.Context, id int) (User, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var u User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, username, email, COALESCE(avatar_url, ''), created_at, trust_level
+		 FROM users WHERE id=$1`,
+		id,
+	).Scan(&u.ID, &u.Username, &u.Email, &u.AvatarURL, &u.CreatedAt, &u.TrustLevel)
+	return u, notFound(err)
+}
+
+func (s *pgStore) UserByName(ctx context.Context, username string) (User, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var u User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, username, email, COALESCE(avatar_url, ''), created_at, trust_level
+		 FROM users WHERE username=$1`,
+		username,
+	).Scan(&u.ID, &u.Username, &u.Email, &u.AvatarURL, &u.CreatedAt, &u.TrustLevel)
+	return u, notFound(err)
+}
+
+func (s *pgStore) UserAccess(ctx context.Context, id int) (int, string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var level int
+	var role string
+	err := s.db.QueryRowContext(ctx, `SELECT trust_level, role FROM users WHERE id=$1`, id).Scan(&level, &role)
+	return level, role, notFound(err)
+}
+
+func (s *pgStore) UsernameReserved(ctx context.Context, name string, uid int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var reserved bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM username_history WHERE lower(old_username)=lower($1) AND user_id<>$2
+		)
+	`, name, uid).Scan(&reserved)
+	return reserved, err
+}
+
+func (s *pgStore) TwoFactorEnabled(ctx context.Context, uid int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var enabled bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id=$1 AND confirmed_at IS NOT NULL)
+	`, uid).Scan(&enabled)
+	return enabled, err
+}
+
+func (s *pgStore) RefreshTrustLevel(ctx context.Context, uid int) error {
+	_, err := recalcTrustLevels(ctx, ` AND u.id = $2`, uid)
+	return err
+}
+
+func (s *pgStore) SetAvatarURL(ctx context.Context, uid int, url string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET avatar_url=$1 WHERE id=$2`, url, uid)
+	return err
+}
+
+func (s *pgStore) TouchLastSeen(ctx context.Context, uid int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET last_seen_at=NOW() WHERE id=$1`, uid)
+	return err
+}
+
+func (s *pgStore) SetRole(ctx context.Context, uid int, role string) error {
+	return s.updateUser(ctx, `UPDATE users SET role=$1 WHERE id=$2`, role, uid)
+}
+
+func (s *pgStore) SetPasswordHash(ctx context.Context, uid int, hash string) error {
+	return s.updateUser(ctx, `UPDATE users SET password_hash=$1 WHERE id=$2`, hash, uid)
+}
+
+// updateUser runs an UPDATE on one user, returning ErrNotFound when no row
+// matched.
+func (s *pgStore) updateUser(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ----- topics -----
+
+const topicColumns = `
+	t.id, t.title, t.content, t.user_id,
+	u.username, COALESCE(u.avatar_url, '') AS avatar_url,
+	to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+	(SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id AND r.status='published') AS reply_count,
+	t.status`
+
+func scanTopics(rows *sql.Rows) ([]Topic, error) {
+	defer rows.Close()
+	var topics []Topic
+	for rows.Next() {
+		var t Topic
+		if err := rows.Scan(
+			&t.ID, &t.Title, &t.Content, &t.UserID,
+			&t.AuthorName, &t.AuthorAvatarURL,
+			&t.CreatedAt, &t.ReplyCount, &t.Status,
+		); err != nil {
+			return nil, err
+		}
+		topics = append(topics, t)
+	}
+	return topics, rows.Err()
+}
+
+func (s *pgStore) ListTopics(ctx context.Context) ([]Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			t.id,
+			t.title,
+			t.content,
+			t.user_id,
+			u.username,
+			COALESCE(u.avatar_url, '') AS avatar_url,
+			to_char(t.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+			COUNT(r.id) AS reply_count,
+			t.status
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		LEFT JOIN replies r ON r.topic_id = t.id AND r.status = 'published'
+		WHERE t.status = 'published'
+		GROUP BY
+			t.id, t.title, t.content, t.user_id, u.username, u.avatar_url, t.created_at
+		ORDER BY t.created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanTopics(rows)
+}
+
+func (s *pgStore) SearchTopics(ctx context.Context, q string) ([]Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+topicColumns+`
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE
+			t.status = 'published' AND (
+				t.title ILIKE '%' || $1 || '%' OR
+				t.content ILIKE '%' || $1 || '%' OR
+				u.username ILIKE '%' || $1 || '%'
+			)
+		ORDER BY t.created_at DESC
+	`, q)
+	if err != nil {
+		return nil, err
+	}
+	return scanTopics(rows)
+}
+
+func (s *pgStore) Topic(ctx context.Context, id int, publishedOnly bool) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var t Topic
+	err := s.db.QueryRowContext(ctx, `
+		SELECT`+topicColumns+`
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.id=$1 AND (t.status='published' OR NOT $2)
+	`, id, publishedOnly).Scan(
+		&t.ID, &t.Title, &t.Content, &t.UserID,
+		&t.AuthorName, &t.AuthorAvatarURL,
+		&t.CreatedAt, &t.ReplyCount, &t.Status,
+	)
+	return t, notFound(err)
+}
+
+func (s *pgStore) TopicOwner(ctx context.Context, id int) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var ownerID int
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM topics WHERE id=$1`, id).Scan(&ownerID)
+	return ownerID, notFound(err)
+}
+
+func (s *pgStore) CreateTopic(ctx context.Context, uid int, title, content, status string) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var id int
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO topics (title, content, user_id, created_at, status)
+		VALUES ($1, $2, $3, NOW(), $4)
+		RETURNING id
+	`, title, content, uid, status).Scan(&id); err != nil {
+		return Topic{}, err
+	}
+	return s.Topic(ctx, id, false)
+}
+
+func (s *pgStore) UpdateTopic(ctx context.Context, id int, title, content, status string) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE topics SET title=$1, content=$2, status=CASE WHEN status='published' THEN $3 ELSE status END
+		WHERE id=$4
+	`, title, content, status, id); err != nil {
+		return Topic{}, err
+	}
+	return s.Topic(ctx, id, false)
+}
+
+func (s *pgStore) DeleteTopic(ctx context.Context, id int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM topics WHERE id=$1`, id)
+	return err
+}
+
+func (s *pgStore) MarkTopicRead(ctx context.Context, uid, topicID int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO topic_reads (user_id, topic_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, topic_id) DO NOTHING
+	`, uid, topicID)
+	return err
+}
+
+// ReindexSearch has nothing to do: Postgres search scans with ILIKE.
+func (s *pgStore) ReindexSearch(ctx context.Context) error {
+	return nil
+}
+
+// ----- replies -----
+
+const replyColumns = `
+	r.id,
+	r.topic_id,
+	r.content,
+	r.user_id,
+	u.username,
+	COALESCE(u.avatar_url, '') AS avatar_url,
+	to_char(r.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') AS created_at,
+	r.status`
+
+func (s *pgStore) ListReplies(ctx context.Context, topicID int) ([]Reply, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+replyColumns+`
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.topic_id=$1 AND r.status='published'
+		ORDER BY r.created_at ASC
+	`, topicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []Reply
+	for rows.Next() {
+		var rp Reply
+		if err := rows.Scan(
+			&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+			&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status,
+		); err != nil {
+			return nil, err
+		}
+		replies = append(replies, rp)
+	}
+	return replies, rows.Err()
+}
+
+func (s *pgStore) ReplyOwner(ctx context.Context, id int) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var ownerID int
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM replies WHERE id=$1`, id).Scan(&ownerID)
+	return ownerID, notFound(err)
+}
+
+func (s *pgStore) CreateReply(ctx context.Context, uid, topicID int, content, status string) (Reply, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var id int
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO replies (topic_id, content, user_id, created_at, status)
+		VALUES ($1, $2, $3, NOW(), $4)
+		RETURNING id
+	`, topicID, content, uid, status).Scan(&id)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+		return Reply{}, ErrNotFound
+	}
+	if err != nil {
+		return Reply{}, err
+	}
+
+	var rp Reply
+	err = s.db.QueryRowContext(ctx, `
+		SELECT`+replyColumns+`
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.id=$1
+	`, id).Scan(
+		&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+		&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status,
+	)
+	return rp, err
+}
+
+func (s *pgStore) UpdateReply(ctx context.Context, id int, content, status string) (string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE replies SET content=$1, status=CASE WHEN status='published' THEN $2 ELSE status END
+		WHERE id=$3 RETURNING status
+	`, content, status, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return status, err
+}
+
+func (s *pgStore) DeleteReply(ctx context.Context, id int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM replies WHERE id=$1`, id)
+	return err
+}
+
+// ----- sessions -----
+
+func (s *pgStore) CreateSession(ctx context.Context, sid string, uid int, expires time.Time, ip, userAgent string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, expires_at, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5)
+	`, sid, uid, expires, ip, userAgent)
+	return err
+}
+
+func (s *pgStore) SessionActive(ctx context.Context, sid string, uid int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var one int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM sessions
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL AND expires_at > NOW()
+	`, sid, uid).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *pgStore) RevokeSession(ctx context.Context, sid string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET revoked_at=NOW() WHERE id=$1 AND revoked_at IS NULL`, sid)
+	return err
+}
+
+func (s *pgStore) RevokeSessions(ctx context.Context, uid int, keep string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at=NOW()
+		WHERE user_id=$1 AND id<>$2 AND revoked_at IS NULL
+	`, uid, keep)
+	return err
+}
+
+func (s *pgStore) SweepSessions(ctx context.Context, before time.Time) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < $1`, before)
+	return err
+}
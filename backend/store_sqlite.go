@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ---------- SQLite store ----------
+//
+// For small deployments without Postgres. Timestamps are stored as UTC text
+// ("YYYY-MM-DD HH:MM:SS", what CURRENT_TIMESTAMP produces) and formatted to
+// ISO with strftime where the Postgres queries use to_char. Search goes
+// through the topics_fts FTS5 index.
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db}
+}
+
+const sqliteISO = `'%Y-%m-%dT%H:%M:%SZ'`
+
+// sqliteTime formats t for comparison with CURRENT_TIMESTAMP columns.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// sqliteCode returns the extended result code of a SQLite error, or 0.
+func sqliteCode(err error) int {
+	var se *sqlite.Error
+	if errors.As(err, &se) {
+		return se.Code()
+	}
+	return 0
+}
+
+// postgresOnly answers 501 on SQLite for features whose queries haven't
+// moved into the Store yet.
+func postgresOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbDriver != driverPostgres {
+			writeError(w, http.StatusNotImplemented, "not_supported", "This feature needs the Postgres backend")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ----- users -----
+
+func (s *sqliteStore) CreateUser(ctx context.Context, u *User, passwordHash string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var createdAt string
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO users (username, email, password_hash)
+		 VALUES ($1, $2, $3)
+		 RETURNING id, strftime(`+sqliteISO+`, created_at)`,
+		u.Username, u.Email, passwordHash,
+	).Scan(&u.ID, &createdAt)
+	if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		switch {
+		case strings.Contains(err.Error(), "users.username"):
+			return ErrUsernameTaken
+		case strings.Contains(err.Error(), "users.email"), strings.Contains(err.Error(), "users_email_lower_key"):
+			return ErrEmailTaken
+		}
+	}
+	if err != nil {
+		return err
+	}
+	u.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+	return err
+}
+
+const sqliteUserColumns = `id, username, email, COALESCE(avatar_url, ''), strftime(` + sqliteISO + `, created_at), trust_level`
+
+func scanSQLiteUser(row *sql.Row, extra ...any) (User, error) {
+	var u User
+	var createdAt string
+	dest := append([]any{&u.ID, &u.Username, &u.Email, &u.AvatarURL, &createdAt, &u.TrustLevel}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return u, notFound(err)
+	}
+	var err error
+	u.CreatedAt, err = time.Parse(time.RFC3339, createdAt)
+	return u, err
+}
+
+func (s *sqliteStore) UserByEmail(ctx context.Context, email string) (User, string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var hash string
+	u, err := scanSQLiteUser(s.db.QueryRowContext(ctx,
+		`SELECT `+sqliteUserColumns+`, password_hash FROM users WHERE lower(email)=$1`, email,
+	), &hash)
+	return u, hash, err
+}
+
+func (s *sqliteStore) UserByID(ctx context.Context, id int) (User, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE id=$1`, id))
+}
+
+func (s *sqliteStore) UserByName(ctx context.Context, username string) (User, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	return scanSQLiteUser(s.db.QueryRowContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE username=$1`, username))
+}
+
+func (s *sqliteStore) UserAccess(ctx context.Context, id int) (int, string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var level int
+	var role string
+	err := s.db.QueryRowContext(ctx, `SELECT trust_level, role FROM users WHERE id=$1`, id).Scan(&level, &role)
+	return level, role, notFound(err)
+}
+
+func (s *sqliteStore) UsernameReserved(ctx context.Context, name string, uid int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var reserved bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM username_history WHERE lower(old_username)=lower($1) AND user_id<>$2
+		)
+	`, name, uid).Scan(&reserved)
+	return reserved, err
+}
+
+// TwoFactorEnabled is always false: enrolling needs the Postgres backend.
+func (s *sqliteStore) TwoFactorEnabled(ctx context.Context, uid int) (bool, error) {
+	return false, nil
+}
+
+// RefreshTrustLevel uses the same stats as recalcTrustLevels, minus flags,
+// which SQLite doesn't store.
+func (s *sqliteStore) RefreshTrustLevel(ctx context.Context, uid int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var createdAt string
+	var st trustStats
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			strftime(`+sqliteISO+`, u.created_at),
+			(SELECT COUNT(*) FROM topic_reads tr WHERE tr.user_id = u.id),
+			(SELECT COUNT(*) FROM replies r WHERE r.user_id = u.id AND r.status = 'published')
+		FROM users u
+		WHERE u.id=$1 AND NOT u.trust_level_locked
+	`, uid).Scan(&createdAt, &st.TopicsRead, &st.RepliesPosted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	created, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return err
+	}
+	st.AccountAge = time.Since(created)
+	_, err = s.db.ExecContext(ctx, `UPDATE users SET trust_level=$1 WHERE id=$2 AND trust_level<>$1`, computeTrustLevel(st), uid)
+	return err
+}
+
+func (s *sqliteStore) SetAvatarURL(ctx context.Context, uid int, url string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET avatar_url=$1 WHERE id=$2`, url, uid)
+	return err
+}
+
+func (s *sqliteStore) TouchLastSeen(ctx context.Context, uid int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET last_seen_at=CURRENT_TIMESTAMP WHERE id=$1`, uid)
+	return err
+}
+
+func (s *sqliteStore) SetRole(ctx context.Context, uid int, role string) error {
+	return s.updateUser(ctx, `UPDATE users SET role=$1 WHERE id=$2`, role, uid)
+}
+
+func (s *sqliteStore) SetPasswordHash(ctx context.Context, uid int, hash string) error {
+	return s.updateUser(ctx, `UPDATE users SET password_hash=$1 WHERE id=$2`, hash, uid)
+}
+
+func (s *sqliteStore) updateUser(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ----- topics -----
+
+const sqliteTopicColumns = `
+	t.id, t.title, t.content, t.user_id,
+	u.username, COALESCE(u.avatar_url, ''),
+	strftime(` + sqliteISO + `, t.created_at),
+	(SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id AND r.status='published'),
+	t.status`
+
+func (s *sqliteStore) ListTopics(ctx context.Context) ([]Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+sqliteTopicColumns+`
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.status = 'published'
+		ORDER BY t.created_at DESC, t.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanTopics(rows)
+}
+
+// ftsQuery turns free text into an FTS5 query: every word must match as a
+// prefix. Quoting each word keeps FTS5 syntax in user input inert.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		if w = strings.ReplaceAll(w, `"`, ""); w != "" {
+			terms = append(terms, `"`+w+`"*`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+func (s *sqliteStore) SearchTopics(ctx context.Context, q string) ([]Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	match := ftsQuery(q)
+	if match == "" {
+		return nil, nil
+	}
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+sqliteTopicColumns+`
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE
+			t.status = 'published' AND (
+				t.id IN (SELECT rowid FROM topics_fts WHERE topics_fts MATCH $1) OR
+				u.username LIKE '%' || $2 || '%' ESCAPE '\'
+			)
+		ORDER BY t.created_at DESC, t.id DESC
+	`, match, like)
+	if err != nil {
+		return nil, err
+	}
+	return scanTopics(rows)
+}
+
+func (s *sqliteStore) Topic(ctx context.Context, id int, publishedOnly bool) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var t Topic
+	err := s.db.QueryRowContext(ctx, `
+		SELECT`+sqliteTopicColumns+`
+		FROM topics t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.id=$1 AND (t.status='published' OR NOT $2)
+	`, id, publishedOnly).Scan(
+		&t.ID, &t.Title, &t.Content, &t.UserID,
+		&t.AuthorName, &t.AuthorAvatarURL,
+		&t.CreatedAt, &t.ReplyCount, &t.Status,
+	)
+	return t, notFound(err)
+}
+
+func (s *sqliteStore) TopicOwner(ctx context.Context, id int) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var ownerID int
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM topics WHERE id=$1`, id).Scan(&ownerID)
+	return ownerID, notFound(err)
+}
+
+func (s *sqliteStore) CreateTopic(ctx context.Context, uid int, title, content, status string) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var id int
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO topics (title, content, user_id, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, title, content, uid, status).Scan(&id); err != nil {
+		return Topic{}, err
+	}
+	return s.Topic(ctx, id, false)
+}
+
+func (s *sqliteStore) UpdateTopic(ctx context.Context, id int, title, content, status string) (Topic, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE topics SET title=$1, content=$2, status=CASE WHEN status='published' THEN $3 ELSE status END
+		WHERE id=$4
+	`, title, content, status, id); err != nil {
+		return Topic{}, err
+	}
+	return s.Topic(ctx, id, false)
+}
+
+func (s *sqliteStore) DeleteTopic(ctx context.Context, id int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM topics WHERE id=$1`, id)
+	return err
+}
+
+func (s *sqliteStore) MarkTopicRead(ctx context.Context, uid, topicID int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO topic_reads (user_id, topic_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, topic_id) DO NOTHING
+	`, uid, topicID)
+	return err
+}
+
+// ReindexSearch rebuilds topics_fts from the topics table.
+func (s *sqliteStore) ReindexSearch(ctx context.Context) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO topics_fts (topics_fts) VALUES ('rebuild')`)
+	return err
+}
+
+// ----- replies -----
+
+const sqliteReplyColumns = `
+	r.id, r.topic_id, r.content, r.user_id,
+	u.username, COALESCE(u.avatar_url, ''),
+	strftime(` + sqliteISO + `, r.created_at),
+	r.status`
+
+func (s *sqliteStore) ListReplies(ctx context.Context, topicID int) ([]Reply, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+sqliteReplyColumns+`
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.topic_id=$1 AND r.status='published'
+		ORDER BY r.created_at ASC, r.id ASC
+	`, topicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []Reply
+	for rows.Next() {
+		var rp Reply
+		if err := rows.Scan(
+			&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+			&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status,
+		); err != nil {
+			return nil, err
+		}
+		replies = append(replies, rp)
+	}
+	return replies, rows.Err()
+}
+
+func (s *sqliteStore) ReplyOwner(ctx context.Context, id int) (int, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var ownerID int
+	err := s.db.QueryRowContext(ctx, `SELECT user_id FROM replies WHERE id=$1`, id).Scan(&ownerID)
+	return ownerID, notFound(err)
+}
+
+func (s *sqliteStore) CreateReply(ctx context.Context, uid, topicID int, content, status string) (Reply, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var id int
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO replies (topic_id, content, user_id, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, topicID, content, uid, status).Scan(&id)
+	if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY {
+		return Reply{}, ErrNotFound
+	}
+	if err != nil {
+		return Reply{}, err
+	}
+
+	var rp Reply
+	err = s.db.QueryRowContext(ctx, `
+		SELECT`+sqliteReplyColumns+`
+		FROM replies r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.id=$1
+	`, id).Scan(
+		&rp.ID, &rp.TopicID, &rp.Content, &rp.UserID,
+		&rp.AuthorName, &rp.AuthorAvatarURL, &rp.CreatedAt, &rp.Status,
+	)
+	return rp, err
+}
+
+func (s *sqliteStore) UpdateReply(ctx context.Context, id int, content, status string) (string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE replies SET content=$1, status=CASE WHEN status='published' THEN $2 ELSE status END
+		WHERE id=$3 RETURNING status
+	`, content, status, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return status, err
+}
+
+func (s *sqliteStore) DeleteReply(ctx context.Context, id int) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM replies WHERE id=$1`, id)
+	return err
+}
+
+// ----- sessions -----
+
+func (s *sqliteStore) CreateSession(ctx context.Context, sid string, uid int, expires time.Time, ip, userAgent string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, expires_at, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5)
+	`, sid, uid, sqliteTime(expires), ip, userAgent)
+	return err
+}
+
+func (s *sqliteStore) SessionActive(ctx context.Context, sid string, uid int) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	var one int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM sessions
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`, sid, uid).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqliteStore) RevokeSession(ctx context.Context, sid string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `UPDATE sessions SET revoked_at=CURRENT_TIMESTAMP WHERE id=$1 AND revoked_at IS NULL`, sid)
+	return err
+}
+
+func (s *sqliteStore) RevokeSessions(ctx context.Context, uid int, keep string) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at=CURRENT_TIMESTAMP
+		WHERE user_id=$1 AND id<>$2 AND revoked_at IS NULL
+	`, uid, keep)
+	return err
+}
+
+func (s *sqliteStore) SweepSessions(ctx context.Context, before time.Time) error {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < $1`, sqliteTime(before))
+	return err
+}
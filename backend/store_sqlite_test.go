@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// openTestSQLite points db and store at a migrated SQLite database in a temp
+// dir for the rest of the test, and returns a trust level setter for it.
+func openTestSQLite(t *testing.T) func(uid, level int) {
+	t.Helper()
+	prevDB, prevDriver := db, dbDriver
+	t.Cleanup(func() { db, dbDriver = prevDB, prevDriver })
+
+	if err := openDatabase("sqlite:" + t.TempDir() + "/forum.db"); err != nil {
+		t.Fatal(err)
+	}
+	conn := db
+	t.Cleanup(func() { conn.Close() })
+	if _, err := migrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return func(uid, level int) {
+		if _, err := conn.Exec(`UPDATE users SET trust_level=$1, trust_level_locked=1 WHERE id=$2`, level, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSQLiteHandlers(t *testing.T) {
+	testOnSQLite = true
+	defer func() { testOnSQLite = false }()
+
+	tests := []struct {
+		name string
+		fn   func(*testing.T)
+	}{
+		{"Register", TestRegister},
+		{"Login", TestLogin},
+		{"LogoutRevokesSession", TestLogoutRevokesSession},
+		{"CookieSessionNeedsCSRF", TestCookieSessionNeedsCSRF},
+		{"TopicLifecycle", TestTopicLifecycle},
+		{"CreateTopicChecks", TestCreateTopicChecks},
+		{"HeldTopicsAreHidden", TestHeldTopicsAreHidden},
+		{"EditKeepsModerationStatus", TestEditKeepsModerationStatus},
+		{"Replies", TestReplies},
+		{"DeleteTopicRemovesReplies", TestDeleteTopicRemovesReplies},
+		{"Search", TestSearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.fn)
+	}
+}
+
+func TestSQLitePostgresOnlyRoutes(t *testing.T) {
+	testOnSQLite = true
+	defer func() { testOnSQLite = false }()
+	a := newTestAPI(t)
+	_, tok := a.signup("ada")
+
+	expectProblem(t, a.do("GET", "/conversations", tok, nil), 501, "not_supported")
+	expectProblem(t, a.do("GET", "/users/ada", "", nil), 501, "not_supported")
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	openTestSQLite(t)
+	ctx := context.Background()
+
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran, err := migrateDown(ctx, len(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != len(all) {
+		t.Fatalf("rolled back %d migrations, want %d", len(ran), len(all))
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name<>'schema_migrations'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables left after migrating down", tables)
+	}
+	if _, err := migrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFTSQuery(t *testing.T) {
+	cases := map[string]string{
+		"garden":         `"garden"*`,
+		"  two   words ": `"two"* "words"*`,
+		`"quoted" OR x*`: `"quoted"* "OR"* "x*"*`,
+		`""`:             "",
+	}
+	for in, want := range cases {
+		if got := ftsQuery(in); got != want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDatabaseDriver(t *testing.T) {
+	cases := []struct{ url, driver, dsn string }{
+		{"postgres://u:p@localhost/forum?sslmode=disable", driverPostgres, "postgres://u:p@localhost/forum?sslmode=disable"},
+		{"sqlite:forum.db", driverSQLite, "file:forum.db?" + sqlitePragmas},
+		{"sqlite:///var/lib/forum.db", driverSQLite, "file:/var/lib/forum.db?" + sqlitePragmas},
+		{"sqlite::memory:?cache=shared", driverSQLite, "file::memory:?cache=shared&" + sqlitePragmas},
+	}
+	for _, c := range cases {
+		driver, dsn := databaseDriver(c.url)
+		if driver != c.driver || dsn != c.dsn {
+			t.Errorf("databaseDriver(%q) = %q, %q; want %q, %q", c.url, driver, dsn, c.driver, c.dsn)
+		}
+	}
+}
+
+func TestSQLiteStoreHonoursContext(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	openTestSQLite(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.UserByName(ctx, "ada"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled lookup error = %v, want context.Canceled", err)
+	}
+
+	prev := cfg.Database.QueryTimeout
+	t.Cleanup(func() { cfg.Database.QueryTimeout = prev })
+	cfg.Database.QueryTimeout = time.Nanosecond
+	if _, err := store.UserByName(context.Background(), "ada"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("timed out lookup error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestSQLiteSweepSessions(t *testing.T) {
+	prevStore := store
+	t.Cleanup(func() { store = prevStore })
+	openTestSQLite(t)
+	ctx := context.Background()
+	u := &User{Username: "ada", Email: "ada@example.com"}
+	if err := store.CreateUser(ctx, u, "x"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := store.CreateSession(ctx, "old", u.ID, now.Add(-8*24*time.Hour), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateSession(ctx, "live", u.ID, now.Add(time.Hour), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SweepSessions(ctx, now.Add(-7*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	rows, err := db.Query(`SELECT id FROM sessions`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, id)
+	}
+	if len(left) != 1 || left[0] != "live" {
+		t.Fatalf("sessions left after sweep: %v", left)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Personal access tokens ----------
+//
+// Long-lived API credentials for scripts and bots. They're sent as
+// "Authorization: Bearer wbt_..." like a session token, but only unlock what
+// their scopes allow, and never the account's own security settings.
+
+const (
+	accessTokenPrefix = "wbt_"
+	maxAccessTokens   = 50
+
+	scopeRead         = "read"
+	scopeWriteTopics  = "write:topics"
+	scopeWriteReplies = "write:replies"
+	scopeAdmin        = "admin"
+)
+
+var allScopes = []string{scopeRead, scopeWriteTopics, scopeWriteReplies, scopeAdmin}
+
+// sessionOnlyPaths can't be reached with an access token whatever its scopes,
+// so a leaked token can't mint more tokens or take over the account.
+var sessionOnlyPaths = []string{"/me/tokens", "/me/password", "/me/email", "/me/username", "/me/2fa", "/me/export"}
+
+type AccessToken struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+	LastUsedIP *string  `json:"last_used_ip"`
+	Token      string   `json:"token,omitempty"` // only set on creation
+}
+
+// authenticateAccessToken looks up a wbt_ token, recording its use.
+func authenticateAccessToken(tok string, r *http.Request) (tokenPayload, error) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	var pl tokenPayload
+	if dbDriver != driverPostgres {
+		return pl, fmt.Errorf("access tokens need the Postgres backend")
+	}
+	var scopes []string
+	err := db.QueryRowContext(ctx, `
+		UPDATE access_tokens SET last_used_at=NOW(), last_used_ip=$2
+		WHERE token_hash=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING user_id, scopes
+	`, hashToken(tok), clientIP(r)).Scan(&pl.UserID, pq.Array(&scopes))
+	if err == sql.ErrNoRows {
+		return pl, fmt.Errorf("unknown or expired access token")
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "access token lookup failed", "err", err)
+		return pl, err
+	}
+	pl.Scopes = scopes
+	return pl, nil
+}
+
+// requiredScope maps a request to the scope an access token needs for it.
+// "" means the request can only be made with a login session.
+func requiredScope(r *http.Request) string {
+	p := r.URL.Path
+	if r.Method == http.MethodDelete && p == "/me" {
+		return ""
+	}
+	for _, prefix := range sessionOnlyPaths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return ""
+		}
+	}
+	switch {
+	case strings.HasPrefix(p, "/admin/"), strings.HasPrefix(p, "/mod/"):
+		return scopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return scopeRead
+	case p == "/topics" || strings.HasPrefix(p, "/topics/"):
+		return scopeWriteTopics
+	case p == "/replies" || strings.HasPrefix(p, "/replies/"):
+		return scopeWriteReplies
+	}
+	// anything else (messages, flags, profile edits) needs admin
+	return scopeAdmin
+}
+
+// tokenAllows reports whether scopes cover the request. admin implies all.
+func tokenAllows(scopes []string, r *http.Request) (bool, string) {
+	need := requiredScope(r)
+	if need == "" {
+		return false, need
+	}
+	return slices.Contains(scopes, need) || slices.Contains(scopes, scopeAdmin), need
+}
+
+func loadAccessTokens(ctx context.Context, uid int) ([]AccessToken, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, prefix, scopes,
+		       to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+		       to_char(expires_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+		       to_char(last_used_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+		       last_used_ip
+		FROM access_tokens
+		WHERE user_id=$1 AND revoked_at IS NULL
+		ORDER BY id DESC
+	`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt,
+			&t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// ---------- /me/tokens ----------
+func accessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := loadAccessTokens(ctx, uid)
+		if err != nil {
+			serverError(w, "ACCESS TOKEN LIST", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		var in struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"` // 0 = never
+		}
+		if err := decodeJSON(r, &in); err != nil {
+			badJSON(w, err)
+			return
+		}
+		in.Name = strings.TrimSpace(in.Name)
+		if in.Name == "" || len(in.Name) > 100 {
+			invalidFields(w, FieldError{"name", "invalid_length", "is required (max 100 characters)"})
+			return
+		}
+		if len(in.Scopes) == 0 {
+			invalidFields(w, FieldError{"scopes", "required", "at least one scope is required"})
+			return
+		}
+		for _, s := range in.Scopes {
+			if !slices.Contains(allScopes, s) {
+				invalidFields(w, FieldError{"scopes", "invalid_choice", "unknown scope " + s + " (valid: " + strings.Join(allScopes, ", ") + ")"})
+				return
+			}
+		}
+		if in.ExpiresInDays < 0 || in.ExpiresInDays > 3650 {
+			invalidFields(w, FieldError{"expires_in_days", "out_of_range", "must be between 0 and 3650"})
+			return
+		}
+		if slices.Contains(in.Scopes, scopeAdmin) {
+			role, err := userRole(ctx, uid)
+			if err != nil || (role != roleAdmin && role != roleModerator) {
+				writeError(w, http.StatusForbidden, "forbidden", "Only staff can create admin tokens")
+				return
+			}
+		}
+		slices.Sort(in.Scopes)
+		in.Scopes = slices.Compact(in.Scopes)
+
+		var count int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM access_tokens WHERE user_id=$1 AND revoked_at IS NULL`, uid).Scan(&count); err != nil {
+			serverError(w, "ACCESS TOKEN CREATE", err)
+			return
+		}
+		if count >= maxAccessTokens {
+			writeError(w, http.StatusConflict, "too_many_tokens", "Too many access tokens; revoke some first")
+			return
+		}
+
+		var expires *time.Time
+		if in.ExpiresInDays > 0 {
+			t := time.Now().Add(time.Duration(in.ExpiresInDays) * 24 * time.Hour)
+			expires = &t
+		}
+		tok := accessTokenPrefix + randomToken(24)
+		t := AccessToken{Name: in.Name, Prefix: tok[:len(accessTokenPrefix)+6], Scopes: in.Scopes, Token: tok}
+		err := db.QueryRowContext(ctx, `
+			INSERT INTO access_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id,
+			          to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			          to_char(expires_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+		`, uid, t.Name, hashToken(tok), t.Prefix, pq.Array(t.Scopes), expires).Scan(&t.ID, &t.CreatedAt, &t.ExpiresAt)
+		if err != nil {
+			serverError(w, "ACCESS TOKEN CREATE", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(t)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// ---------- DELETE /me/tokens/{id} ----------
+func revokeAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid token id")
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE access_tokens SET revoked_at=NOW()
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL
+	`, id, getUserID(r))
+	if err != nil {
+		serverError(w, "ACCESS TOKEN REVOKE", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, "token_not_found", "Token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
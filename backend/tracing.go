@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ---------- Tracing ----------
+//
+// OpenTelemetry spans cover every HTTP request (named after its route), every
+// SQL statement, outbound HTTP calls (OIDC, Akismet), mail and background
+// jobs. Incoming W3C traceparent headers are honoured so a request joins the
+// caller's trace. Spans are exported over OTLP/HTTP when
+// OTEL_TRACES_EXPORTER=otlp; otherwise tracing is a no-op.
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`        // none or otlp
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // OTLP/HTTP collector URL
+	ServiceName string  `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"OTEL_TRACES_SAMPLER_ARG"`
+}
+
+var tracer = otel.Tracer("forum-backend")
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// setupTracing installs the exporting tracer provider when one is configured
+// and returns the function that flushes it on shutdown.
+func setupTracing(ctx context.Context, c TracingConfig) (func(context.Context) error, error) {
+	if c.Exporter != "otlp" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var opts []otlptracehttp.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+	}
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(c.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// traced starts the server span. It is named after the method until
+// muxErrors knows the route.
+func traced(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "http", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return spanName(r.Method, infoFor(r).route)
+	}))
+}
+
+// nameSpan gives the request's span its route, e.g. "GET /topics/".
+func nameSpan(r *http.Request, route string) {
+	if route == "" {
+		return
+	}
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(spanName(r.Method, route))
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
+
+func spanName(method, route string) string {
+	if route == "" {
+		return method
+	}
+	return method + " " + strings.TrimPrefix(route, method+" ")
+}
+
+// tracedTransport is for the http.Clients that call other services.
+func tracedTransport() http.RoundTripper {
+	return otelhttp.NewTransport(http.DefaultTransport)
+}
+
+// sqlTracing names SQL spans after the statement, e.g. "sql.query SELECT
+// topics", and records the rows scanned as span events.
+func sqlTracing(driver string) []otelsql.Option {
+	system := semconv.DBSystemNamePostgreSQL
+	if driver == driverSQLite {
+		system = semconv.DBSystemNameSQLite
+	}
+	return []otelsql.Option{
+		otelsql.WithAttributes(system),
+		otelsql.WithSpanNameFormatter(func(_ context.Context, method otelsql.Method, query string) string {
+			if name := statementName(query); name != "" {
+				return string(method) + " " + name
+			}
+			return string(method)
+		}),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			RowsNext:             true,
+			DisableErrSkip:       true,
+			OmitConnResetSession: true,
+		}),
+	}
+}
+
+var (
+	sqlVerbRe   = regexp.MustCompile(`(?i)^\s*(?:--[^\n]*\n\s*)*(WITH|SELECT|INSERT|UPDATE|DELETE)\b`)
+	sqlTableRe  = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+([a-z_][a-z0-9_]*)`)
+	sqlParensRe = regexp.MustCompile(`\([^()]*\)`)
+)
+
+// statementName sums a query up as its verb and main table, which is enough
+// to tell statements apart in a trace without the full text. Subqueries are
+// skipped so a count in the select list doesn't name the statement.
+func statementName(query string) string {
+	verb := sqlVerbRe.FindStringSubmatch(query)
+	if verb == nil {
+		return ""
+	}
+	name := strings.ToUpper(verb[1])
+	for outer := ""; outer != query; {
+		outer, query = query, sqlParensRe.ReplaceAllString(query, "")
+	}
+	if t := sqlTableRe.FindStringSubmatch(query); t != nil {
+		name += " " + strings.ToLower(t[1])
+	}
+	return name
+}
+
+// failSpan marks the current span as failed with err.
+func failSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
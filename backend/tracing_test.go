@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStatementName(t *testing.T) {
+	cases := map[string]string{
+		"SELECT id FROM users WHERE id=$1":                                            "SELECT users",
+		"\n\t\tselect t.id, COUNT(r.id) FROM topics t LEFT JOIN replies":              "SELECT topics",
+		"INSERT INTO sessions (id, user_id) VALUES ($1, $2)":                          "INSERT sessions",
+		"UPDATE users SET last_seen_at=NOW()":                                         "UPDATE users",
+		"DELETE FROM data_exports WHERE created_at < $1":                              "DELETE data_exports",
+		"SELECT (SELECT COUNT(*) FROM replies r WHERE r.topic_id=t.id) FROM topics t": "SELECT topics",
+		"SELECT 1":                    "SELECT",
+		"SELECT pg_advisory_lock($1)": "SELECT",
+		"BEGIN":                       "",
+	}
+	for query, want := range cases {
+		if got := statementName(query); got != want {
+			t.Errorf("statementName(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestRequestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	testOnSQLite = true
+	defer func() { testOnSQLite = false }()
+	a := newTestAPI(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	expectStatus(t, a.do("GET", "/topics", "", nil, "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01"), 200)
+
+	var names []string
+	var server, query bool
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID().String() != traceID {
+			continue
+		}
+		names = append(names, s.Name())
+		server = server || s.Name() == "GET /topics"
+		query = query || strings.HasPrefix(s.Name(), "sql.") && strings.HasSuffix(s.Name(), "SELECT topics")
+	}
+	if !server || !query {
+		t.Errorf("spans in the caller's trace = %q, want the request and its topics query", names)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Trust levels ----------
+//
+// Levels are computed from account age, topics read, replies written and
+// flags received, and unlock capabilities step by step. Moderators and admins
+// bypass every gate. Admins can pin a user's level, which the periodic
+// recalculation then leaves alone.
+
+const (
+	trustNew     = 0
+	trustBasic   = 1
+	trustMember  = 2
+	trustRegular = 3
+)
+
+type trustRequirement struct {
+	MinAge      time.Duration
+	MinRead     int
+	MinReplies  int
+	MaxFlagsRcv int // flags received within flagWindow
+}
+
+// requirements for levels 1..3, index 0 is unused
+var trustRequirements = [...]trustRequirement{
+	{},
+	{MinAge: 10 * time.Minute, MinRead: 3, MaxFlagsRcv: 5},
+	{MinAge: 15 * 24 * time.Hour, MinRead: 30, MinReplies: 5, MaxFlagsRcv: 3},
+	{MinAge: 60 * 24 * time.Hour, MinRead: 100, MinReplies: 30, MaxFlagsRcv: 0},
+}
+
+const flagWindow = 100 * 24 * time.Hour
+
+type capability string
+
+const (
+	capCreateTopics capability = "create_topics"
+	capPostLinks    capability = "post_links"
+	capUploadImages capability = "upload_images"
+)
+
+var capabilityLevel = map[capability]int{
+	capCreateTopics: trustBasic,
+	capPostLinks:    trustBasic,
+	capUploadImages: trustBasic,
+}
+
+// flag weight by trust level; staff flags count as much as a regular's
+var flagWeights = [...]int{1, 1, 2, 3}
+
+// posts whose flag weight reaches this go back to the moderation queue
+const flagHideThreshold = 5
+
+type trustStats struct {
+	AccountAge    time.Duration
+	TopicsRead    int
+	RepliesPosted int
+	FlagsReceived int
+}
+
+func computeTrustLevel(s trustStats) int {
+	level := trustNew
+	for l := trustBasic; l <= trustRegular; l++ {
+		req := trustRequirements[l]
+		if s.AccountAge < req.MinAge || s.TopicsRead < req.MinRead ||
+			s.RepliesPosted < req.MinReplies || s.FlagsReceived > req.MaxFlagsRcv {
+			break
+		}
+		level = l
+	}
+	return level
+}
+
+const trustStatsQuery = `
+	SELECT
+		u.id,
+		u.created_at,
+		(SELECT COUNT(*) FROM topic_reads tr WHERE tr.user_id = u.id),
+		(SELECT COUNT(*) FROM replies r WHERE r.user_id = u.id AND r.status = 'published'),
+		(SELECT COUNT(*) FROM flags f WHERE f.target_user_id = u.id AND f.created_at > $1)
+	FROM users u
+	WHERE NOT u.trust_level_locked`
+
+// trustBatchSize users are read and updated under one query timeout, so a
+// full recalculation isn't bounded by a single timeout however many users
+// there are.
+const trustBatchSize = 500
+
+// recalcTrustLevels recalculates the users matching where (appended to
+// trustStatsQuery, with args from $2 on) and returns how many changed level.
+func recalcTrustLevels(ctx context.Context, where string, args ...any) (int, error) {
+	args = append([]any{time.Now().Add(-flagWindow)}, args...)
+	changed, after := 0, 0
+	for {
+		n, last, err := recalcTrustBatch(ctx, where, args, after)
+		changed += n
+		if err != nil || last == 0 {
+			return changed, err
+		}
+		if err := ctx.Err(); err != nil {
+			return changed, err
+		}
+		after = last
+	}
+}
+
+// recalcTrustBatch recalculates the next batch of users with IDs above after
+// and writes the new levels in one statement. last is the highest ID seen, or
+// 0 once there are no more users.
+func recalcTrustBatch(ctx context.Context, where string, args []any, after int) (changed, last int, err error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	query := fmt.Sprintf("%s%s AND u.id > $%d ORDER BY u.id LIMIT %d", trustStatsQuery, where, len(args)+1, trustBatchSize)
+	rows, err := db.QueryContext(ctx, query, append(slices.Clip(args), after)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids, levels []int64
+	for rows.Next() {
+		var id int
+		var createdAt time.Time
+		var s trustStats
+		if err := rows.Scan(&id, &createdAt, &s.TopicsRead, &s.RepliesPosted, &s.FlagsReceived); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		s.AccountAge = time.Since(createdAt)
+		ids = append(ids, int64(id))
+		levels = append(levels, int64(computeTrustLevel(s)))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users u SET trust_level = v.level
+		FROM unnest($1::int[], $2::int[]) AS v(id, level)
+		WHERE u.id = v.id AND u.trust_level <> v.level AND NOT u.trust_level_locked
+	`, pq.Array(ids), pq.Array(levels))
+	if err != nil {
+		return 0, 0, err
+	}
+	n, _ := res.RowsAffected()
+	if len(ids) == trustBatchSize {
+		last = int(ids[len(ids)-1])
+	}
+	return int(n), last, nil
+}
+
+// refreshTrustLevel recalculates a single user, e.g. right after login so a
+// newly earned level doesn't wait for the next periodic run.
+func refreshTrustLevel(ctx context.Context, uid int) {
+	if err := store.RefreshTrustLevel(ctx, uid); err != nil {
+		slog.ErrorContext(ctx, "trust level refresh failed", "user_id", uid, "err", err)
+	}
+}
+
+// trustLoop recalculates everyone once at startup and then periodically.
+func trustLoop(ctx context.Context, every time.Duration) {
+	runEvery(ctx, "trust-recalc", every, true, func(ctx context.Context) {
+		n, err := recalcTrustLevels(ctx, "")
+		if err != nil {
+			slog.ErrorContext(ctx, "trust level recalculation failed", "err", err)
+		} else if n > 0 {
+			slog.Info("trust levels recalculated", "changed", n)
+		}
+	})
+}
+
+// can reports whether the user may use the capability.
+func can(ctx context.Context, uid int, c capability) (bool, error) {
+	level, role, err := store.UserAccess(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	if role == roleModerator || role == roleAdmin {
+		return true, nil
+	}
+	return level >= capabilityLevel[c], nil
+}
+
+// requireCapability writes a 403 and returns false when the signed-in user
+// lacks c.
+func requireCapability(w http.ResponseWriter, r *http.Request, c capability) bool {
+	ok, err := can(r.Context(), getUserID(r), c)
+	if err != nil {
+		serverError(w, "TRUST LOOKUP", err)
+		return false
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "trust_level_too_low", "Your trust level does not allow this yet ("+string(c)+")")
+		return false
+	}
+	return true
+}
+
+func containsLink(s string) bool {
+	return linkRe.MatchString(s)
+}
+
+func markTopicRead(ctx context.Context, uid, topicID int) {
+	if err := store.MarkTopicRead(ctx, uid, topicID); err != nil {
+		slog.ErrorContext(ctx, "topic read tracking failed", "user_id", uid, "topic_id", topicID, "err", err)
+	}
+}
+
+// ---------- /flags ----------
+func flagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	uid := getUserID(r)
+
+	var payload struct {
+		Kind   string `json:"kind"` // "topic" or "reply"
+		ID     int    `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	var ownerQuery, hideQuery string
+	switch payload.Kind {
+	case "topic":
+		ownerQuery = `SELECT user_id FROM topics WHERE id=$1 AND status='published'`
+		hideQuery = `UPDATE topics SET status='pending' WHERE id=$1 AND status='published'`
+	case "reply":
+		ownerQuery = `SELECT user_id FROM replies WHERE id=$1 AND status='published'`
+		hideQuery = `UPDATE replies SET status='pending' WHERE id=$1 AND status='published'`
+	default:
+		invalidFields(w, FieldError{"kind", "invalid_choice", `must be "topic" or "reply"`})
+		return
+	}
+
+	var ownerID int
+	if err := db.QueryRowContext(ctx, ownerQuery, payload.ID).Scan(&ownerID); err != nil {
+		writeError(w, 404, "post_not_found", "Post not found")
+		return
+	}
+	if ownerID == uid {
+		writeError(w, 400, "own_post", "You can't flag your own post")
+		return
+	}
+
+	var level int
+	var role string
+	if err := db.QueryRowContext(ctx, `SELECT trust_level, role FROM users WHERE id=$1`, uid).Scan(&level, &role); err != nil {
+		serverError(w, "FLAG", err)
+		return
+	}
+	weight := flagWeights[level]
+	if role == roleModerator || role == roleAdmin {
+		weight = flagWeights[trustRegular]
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO flags (user_id, target_kind, target_id, target_user_id, reason, weight)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, target_kind, target_id) DO NOTHING
+	`, uid, payload.Kind, payload.ID, ownerID, payload.Reason, weight)
+	if err != nil {
+		serverError(w, "FLAG", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusConflict, "already_flagged", "Already flagged")
+		return
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(weight), 0) FROM flags WHERE target_kind=$1 AND target_id=$2`,
+		payload.Kind, payload.ID).Scan(&total); err != nil {
+		slog.ErrorContext(ctx, "flag weight lookup failed", "err", err)
+	}
+	hidden := false
+	if total >= flagHideThreshold {
+		if _, err := db.ExecContext(ctx, hideQuery, payload.ID); err != nil {
+			slog.ErrorContext(ctx, "hiding flagged post failed", "err", err)
+		} else {
+			hidden = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"weight": weight,
+		"hidden": hidden,
+	})
+}
+
+// ---------- /admin/users/{id}/trust-level ----------
+//
+// {"trust_level": 2} pins the level, {"locked": false} hands the user back to
+// the automatic calculation.
+func adminTrustLevelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "invalid_id", "Invalid ID")
+		return
+	}
+
+	var payload struct {
+		TrustLevel *int  `json:"trust_level"`
+		Locked     *bool `json:"locked"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	var res sql.Result
+	switch {
+	case payload.TrustLevel != nil:
+		if *payload.TrustLevel < trustNew || *payload.TrustLevel > trustRegular {
+			invalidFields(w, FieldError{"trust_level", "out_of_range", "must be between 0 and 3"})
+			return
+		}
+		res, err = db.ExecContext(ctx, `UPDATE users SET trust_level=$1, trust_level_locked=true WHERE id=$2`, *payload.TrustLevel, id)
+	case payload.Locked != nil && !*payload.Locked:
+		res, err = db.ExecContext(ctx, `UPDATE users SET trust_level_locked=false WHERE id=$1`, id)
+	default:
+		invalidFields(w, FieldError{"trust_level", "required", `send "trust_level" or "locked": false`})
+		return
+	}
+	if err != nil {
+		serverError(w, "TRUST OVERRIDE", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, 404, "user_not_found", "User not found")
+		return
+	}
+	if payload.TrustLevel == nil {
+		refreshTrustLevel(ctx, id)
+	}
+
+	var level int
+	var locked bool
+	_ = db.QueryRowContext(ctx, `SELECT trust_level, trust_level_locked FROM users WHERE id=$1`, id).Scan(&level, &locked)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":                 id,
+		"trust_level":        level,
+		"trust_level_locked": locked,
+	})
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ---------- Two-factor authentication ----------
+//
+// Enrolment: POST /me/2fa/setup returns a secret, POST /me/2fa/enable confirms
+// it with a first code and hands out recovery codes. Afterwards /login only
+// returns a short-lived challenge, which /login/2fa exchanges for a session
+// together with a TOTP or recovery code.
+
+const (
+	challengeTTL       = 5 * time.Minute
+	recoveryCodeCount  = 10
+	settingRequire2FA  = "require_2fa_roles"
+	totpIssuerFallback = "Webby"
+)
+
+type challengePayload struct {
+	UserID  int    `json:"uid"`
+	Purpose string `json:"p"`
+	Exp     int64  `json:"exp"`
+}
+
+// makeChallenge signs a token proving the password step succeeded. It has no
+// session ID, so requireAuth never accepts it.
+func makeChallenge(uid int) (string, error) {
+	b, err := json.Marshal(challengePayload{UserID: uid, Purpose: "2fa", Exp: time.Now().Add(challengeTTL).Unix()})
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(b)
+	return p + "." + sign(p), nil
+}
+
+func parseChallenge(tok string) (int, error) {
+	p, sig, ok := strings.Cut(tok, ".")
+	if !ok || !hmac.Equal([]byte(sign(p)), []byte(sig)) {
+		return 0, fmt.Errorf("bad challenge")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return 0, fmt.Errorf("bad challenge")
+	}
+	var pl challengePayload
+	if err := json.Unmarshal(b, &pl); err != nil || pl.Purpose != "2fa" {
+		return 0, fmt.Errorf("bad challenge")
+	}
+	if time.Now().Unix() > pl.Exp {
+		return 0, fmt.Errorf("challenge expired")
+	}
+	return pl.UserID, nil
+}
+
+func totpEnabled(ctx context.Context, uid int) (bool, error) {
+	return store.TwoFactorEnabled(ctx, uid)
+}
+
+// required2FARoles returns the roles the admin policy forces to use 2FA.
+func required2FARoles(ctx context.Context) ([]string, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	if dbDriver != driverPostgres {
+		// no site_settings (or 2FA) without Postgres
+		return []string{}, nil
+	}
+	var raw string
+	err := db.QueryRowContext(ctx, `SELECT value FROM site_settings WHERE key=$1`, settingRequire2FA).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roles := []string{}
+	err = json.Unmarshal([]byte(raw), &roles)
+	return roles, err
+}
+
+func roleRequires2FA(ctx context.Context, role string) (bool, error) {
+	roles, err := required2FARoles(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newRecoveryCodes(ctx context.Context, tx *sql.Tx, uid int) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, uid); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		c := strings.ToLower(newTOTPSecret()[:10])
+		codes[i] = c[:5] + "-" + c[5:]
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			uid, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code and consumes it.
+func checkSecondFactor(ctx context.Context, uid int, code, recoveryCode string) (bool, error) {
+	ctx, cancel := dbCtx(ctx)
+	defer cancel()
+	if recoveryCode != "" {
+		res, err := db.ExecContext(ctx, `
+			UPDATE recovery_codes SET used_at=NOW()
+			WHERE id = (
+				SELECT id FROM recovery_codes
+				WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL
+				LIMIT 1
+			)
+		`, uid, hashToken(strings.ToLower(strings.TrimSpace(recoveryCode))))
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	var secret string
+	var lastStep int64
+	err := db.QueryRowContext(ctx, `SELECT secret, last_used_step FROM user_totp WHERE user_id=$1 AND confirmed_at IS NOT NULL`, uid).
+		Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+	// the WHERE guards against two concurrent requests using the same code
+	res, err := db.ExecContext(ctx, `UPDATE user_totp SET last_used_step=$1 WHERE user_id=$2 AND last_used_step < $1`, step, uid)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// ---------- POST /login/2fa ----------
+func login2FAHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	var payload struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		Cookie       bool   `json:"cookie"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	uid, err := parseChallenge(payload.Challenge)
+	if err != nil {
+		writeError(w, 401, "invalid_challenge", "Login challenge invalid or expired, sign in again")
+		return
+	}
+
+	key := "2fa:" + strconv.Itoa(uid)
+	ip := clientIP(r)
+	if wait, _ := logins.reserve(key, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed attempts, try again later")
+		return
+	}
+
+	ok, err := checkSecondFactor(ctx, uid, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		logins.refund(key, ip)
+		serverError(w, "2FA LOGIN", err)
+		return
+	}
+	if !ok {
+		loginFailures.WithLabelValues("2fa").Inc()
+		writeError(w, 401, "invalid_2fa_code", "Invalid authentication code")
+		return
+	}
+	logins.succeed(key, ip)
+
+	var user User
+	if err := db.QueryRowContext(ctx,
+		`SELECT id, username, email, COALESCE(avatar_url, ''), created_at FROM users WHERE id=$1`, uid,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.AvatarURL, &user.CreatedAt); err != nil {
+		serverError(w, "2FA LOGIN", err)
+		return
+	}
+	completeLogin(w, r, user, payload.Cookie)
+}
+
+// ---------- GET /me/2fa ----------
+func twoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	enabled, err := totpEnabled(ctx, uid)
+	if err != nil {
+		serverError(w, "2FA STATUS", err)
+		return
+	}
+	var remaining int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM recovery_codes WHERE user_id=$1 AND used_at IS NULL`, uid).Scan(&remaining)
+	role, _ := userRole(ctx, uid)
+	required, _ := roleRequires2FA(ctx, role)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"enabled":                  enabled,
+		"required":                 required,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// ---------- POST /me/2fa/setup ----------
+func twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+	ok, err := checkPassword(ctx, uid, payload.Password)
+	if err != nil {
+		serverError(w, "2FA SETUP", err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "wrong_password", "Password is incorrect")
+		return
+	}
+
+	enabled, err := totpEnabled(ctx, uid)
+	if err != nil {
+		serverError(w, "2FA SETUP", err)
+		return
+	}
+	if enabled {
+		writeError(w, http.StatusConflict, "2fa_already_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret := newTOTPSecret()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, last_used_step=0, created_at=NOW()
+	`, uid, secret); err != nil {
+		serverError(w, "2FA SETUP", err)
+		return
+	}
+
+	var email string
+	_ = db.QueryRowContext(ctx, `SELECT email FROM users WHERE id=$1`, uid).Scan(&email)
+	issuer := cfg.TOTPIssuer
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(issuer, email, secret),
+	})
+}
+
+// ---------- POST /me/2fa/enable ----------
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	var secret string
+	err := db.QueryRowContext(ctx, `SELECT secret FROM user_totp WHERE user_id=$1 AND confirmed_at IS NULL`, uid).Scan(&secret)
+	if err == sql.ErrNoRows {
+		writeError(w, 400, "2fa_not_started", "Start enrolment with /me/2fa/setup first")
+		return
+	}
+	if err != nil {
+		serverError(w, "2FA ENABLE", err)
+		return
+	}
+	step, ok := verifyTOTP(secret, payload.Code, time.Now(), 0)
+	if !ok {
+		writeError(w, 400, "invalid_2fa_code", "Invalid authentication code")
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "2FA ENABLE", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE user_totp SET confirmed_at=NOW(), last_used_step=$1 WHERE user_id=$2`, step, uid); err != nil {
+		serverError(w, "2FA ENABLE", err)
+		return
+	}
+	codes, err := newRecoveryCodes(ctx, tx, uid)
+	if err != nil {
+		serverError(w, "2FA ENABLE", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, "2FA ENABLE", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// ---------- POST /me/2fa/recovery-codes ----------
+//
+// Replaces all recovery codes; needs a current TOTP code.
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	key := "2fa:" + strconv.Itoa(uid)
+	ip := clientIP(r)
+	if wait, _ := logins.reserve(key, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed attempts, try again later")
+		return
+	}
+	ok, err := checkSecondFactor(ctx, uid, payload.Code, "")
+	if err != nil {
+		logins.refund(key, ip)
+		serverError(w, "RECOVERY CODES", err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "invalid_2fa_code", "Invalid authentication code")
+		return
+	}
+	logins.succeed(key, ip)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(w, "RECOVERY CODES", err)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := newRecoveryCodes(ctx, tx, uid)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		serverError(w, "RECOVERY CODES", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"recovery_codes": codes,
+	})
+}
+
+// ---------- DELETE /me/2fa ----------
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	uid := getUserID(r)
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := decodeJSON(r, &payload); err != nil {
+		badJSON(w, err)
+		return
+	}
+
+	role, err := userRole(ctx, uid)
+	if err != nil {
+		serverError(w, "2FA DISABLE", err)
+		return
+	}
+	if required, err := roleRequires2FA(ctx, role); err != nil {
+		serverError(w, "2FA DISABLE", err)
+		return
+	} else if required {
+		writeError(w, http.StatusForbidden, "2fa_required", "Two-factor authentication is required for your role")
+		return
+	}
+
+	key := "2fa:" + strconv.Itoa(uid)
+	ip := clientIP(r)
+	if wait, _ := logins.reserve(key, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed attempts, try again later")
+		return
+	}
+	ok, err := checkPassword(ctx, uid, payload.Password)
+	if err != nil {
+		logins.refund(key, ip)
+		serverError(w, "2FA DISABLE", err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "wrong_password", "Password is incorrect")
+		return
+	}
+	ok, err = checkSecondFactor(ctx, uid, payload.Code, "")
+	if err != nil {
+		logins.refund(key, ip)
+		serverError(w, "2FA DISABLE", err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusForbidden, "invalid_2fa_code", "Invalid authentication code")
+		return
+	}
+	logins.succeed(key, ip)
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id=$1`, uid); err != nil {
+		serverError(w, "2FA DISABLE", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, uid); err != nil {
+		slog.ErrorContext(ctx, "recovery code cleanup failed", "user_id", uid, "err", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------- /admin/security-policy ----------
+func securityPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbCtx(r.Context())
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		// current policy is written below
+
+	case http.MethodPut:
+		var payload struct {
+			Require2FARoles []string `json:"require_2fa_roles"`
+		}
+		if err := decodeJSON(r, &payload); err != nil {
+			badJSON(w, err)
+			return
+		}
+		roles := []string{}
+		for _, role := range payload.Require2FARoles {
+			if role != roleModerator && role != roleAdmin {
+				invalidFields(w, FieldError{"require_2fa_roles", "invalid_choice", "may only contain privileged roles (moderator, admin)"})
+				return
+			}
+			roles = append(roles, role)
+		}
+		raw, _ := json.Marshal(roles)
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO site_settings (key, value) VALUES ($1, $2)
+			ON CONFLICT (key) DO UPDATE SET value=EXCLUDED.value
+		`, settingRequire2FA, string(raw)); err != nil {
+			serverError(w, "SECURITY POLICY", err)
+			return
+		}
+
+	default:
+		methodNotAllowed(w)
+		return
+	}
+
+	roles, err := required2FARoles(ctx)
+	if err != nil {
+		serverError(w, "SECURITY POLICY", err)
+		return
+	}
+	// who would currently be locked out of privileged endpoints
+	missing := []string{}
+	if len(roles) > 0 {
+		rows, err := db.QueryContext(ctx, `
+			SELECT u.username FROM users u
+			WHERE u.role = ANY($1)
+				AND NOT EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id=u.id AND t.confirmed_at IS NOT NULL)
+			ORDER BY u.username
+		`, pq.Array(roles))
+		if err == nil {
+			for rows.Next() {
+				var name string
+				if rows.Scan(&name) == nil {
+					missing = append(missing, name)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"require_2fa_roles": roles,
+		"users_without_2fa": missing,
+	})
+}
@@ -0,0 +1,21 @@
+// The API answers errors with application/problem+json documents:
+// { code, detail, errors: [{ field, message }], request_id }.
+
+export function problemMessage(problem, fallback = "Something went wrong.") {
+  if (!problem) return fallback;
+  if (typeof problem === "string") return problem;
+  if (problem.errors?.length) {
+    return problem.errors.map((e) => `${e.field} ${e.message}`).join(", ");
+  }
+  return problem.detail || problem.title || fallback;
+}
+
+// errorText reads a failed fetch() response into a readable message.
+export async function errorText(res, fallback) {
+  const body = await res.text();
+  try {
+    return problemMessage(JSON.parse(body), fallback);
+  } catch {
+    return body || fallback;
+  }
+}
@@ -1,6 +1,7 @@
 import React, { useEffect, useRef, useState } from "react";
 import { useNavigate } from "react-router-dom";
 import searchlogo from "../assets/search.png";
+import { errorText } from "../api";
 
 function Header({ user, onLogout, setAuth }) {
   const navigate = useNavigate();
@@ -74,7 +75,7 @@ function Header({ user, onLogout, setAuth }) {
     });
 
     if (!res.ok) {
-      alert(await res.text());
+      alert(await errorText(res));
       return;
     }
 
@@ -1,5 +1,6 @@
 import React, { useState } from "react";
 import { useNavigate } from "react-router-dom";
+import { errorText } from "../api";
 import.meta.env.VITE_API_URL;
 
 function CreateTopic({ addTopic, auth }) {
@@ -33,7 +34,7 @@ function CreateTopic({ addTopic, auth }) {
       });
 
       if (!res.ok) {
-        const msg = await res.text();
+        const msg = await errorText(res);
         throw new Error(msg || "Failed to create topic");
       }
 
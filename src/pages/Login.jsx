@@ -3,6 +3,7 @@ import { Link, useNavigate } from "react-router-dom";
 import axios from "axios";
 import.meta.env.VITE_API_URL;
 import Header from "../components/Header";
+import { problemMessage } from "../api";
 
 export default function Login({ setAuth }) {
   const navigate = useNavigate();
@@ -35,7 +36,7 @@ export default function Login({ setAuth }) {
 
       navigate("/");
     } catch (err) {
-      if (err.response?.data) setError(err.response.data);
+      if (err.response?.data) setError(problemMessage(err.response.data));
       else setError("Login failed. Please try again.");
     }
   };
@@ -2,6 +2,7 @@ import { useState } from "react";
 import { Link, useNavigate } from "react-router-dom";
 import axios from "axios";
 import Header from "../components/Header";
+import { problemMessage } from "../api";
 import.meta.env.VITE_API_URL;
 
 export default function Register() {
@@ -33,7 +34,7 @@ export default function Register() {
       navigate("/login");
     } catch (err) {
       console.error(err);
-      if (err.response) setError(err.response.data);
+      if (err.response) setError(problemMessage(err.response.data));
       else setError("Something went wrong. Please try again.");
     }
   };
@@ -1,6 +1,7 @@
 import React, { useEffect, useMemo, useRef, useState } from "react";
 import { useParams, useNavigate } from "react-router-dom";
 import Header from "../components/Header";
+import { errorText } from "../api";
 
 /* ---------------- DATE HELPERS ---------------- */
 
@@ -381,7 +382,7 @@ function Topic({ auth, setAuth }) {
       body: JSON.stringify({ title: editTopicTitle, content: editTopicContent }),
     });
 
-    if (!res.ok) return alert(await res.text());
+    if (!res.ok) return alert(await errorText(res));
 
     const updated = await res.json();
     setTopic(updated);
@@ -397,7 +398,7 @@ function Topic({ auth, setAuth }) {
       headers: { Authorization: `Bearer ${token}` },
     });
 
-    if (!res.ok) return alert(await res.text());
+    if (!res.ok) return alert(await errorText(res));
     navigate("/");
   };
 
@@ -414,7 +415,7 @@ function Topic({ auth, setAuth }) {
       body: JSON.stringify({ topic_id: Number(id), content: newReply }),
     });
 
-    if (!res.ok) return alert(await res.text());
+    if (!res.ok) return alert(await errorText(res));
 
     const created = await res.json();
     const safeCreated = {
@@ -448,7 +449,7 @@ function Topic({ auth, setAuth }) {
       body: JSON.stringify({ content: editReplyContent }),
     });
 
-    if (!res.ok) return alert(await res.text());
+    if (!res.ok) return alert(await errorText(res));
 
     setReplies((prev) =>
       prev.map((r) =>
@@ -467,7 +468,7 @@ function Topic({ auth, setAuth }) {
       headers: { Authorization: `Bearer ${token}` },
     });
 
-    if (!res.ok) return alert(await res.text());
+    if (!res.ok) return alert(await errorText(res));
 
     setReplies((prev) => prev.filter((r) => r.id !== replyId));
   };